@@ -2,48 +2,341 @@ package html2gemini
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net/url"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 
 	"github.com/olekukonko/tablewriter"
 	"github.com/ssor/bom"
 	"golang.org/x/net/html"
 	"golang.org/x/net/html/atom"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/net/idna"
 )
 
 // Options provide toggles and overrides to control specific rendering behaviors.
 type Options struct {
-	PrettyTables                bool                 // Turns on pretty ASCII rendering for table elements.
-	PrettyTablesOptions         *PrettyTablesOptions // Configures pretty ASCII rendering for table elements.
-	OmitLinks                   bool                 // Turns on omitting links
-	CitationStart               int                  //Start Citations from this number (default 1)
-	CitationMarkers             bool                 //use footnote style citation markers
-	LinkEmitFrequency           int                  //emit gathered links after approximately every n paras (otherwise when new heading, or blockquote)
-	NumberedLinks               bool                 // number the links [1], [2] etc to match citation markers
-	EmitImagesAsLinks           bool                 //emit referenced images as links e.g. <img src=href>
-	ImageMarkerPrefix           string               //prefix when emitting images
-	EmptyLinkPrefix             string               //prefix when emitting empty links (e.g. <a href=foo><img src=bar></a>
-	ListItemToLinkWordThreshold int                  //max number of words in a list item having a single link that is converted to a plain gemini link
-}
-
-//NewOptions creates Options with default settings
-func NewOptions() *Options {
-	return &Options{
+	PrettyTables                bool                         // Turns on pretty ASCII rendering for table elements.
+	PrettyTablesOptions         *PrettyTablesOptions         // Configures pretty ASCII rendering for table elements.
+	OmitLinks                   bool                         // Turns on omitting links
+	CitationStart               int                          //Start Citations from this number (default 1)
+	CitationMarkers             bool                         //Deprecated: set CitationStyle, which is the only setting read unless it is left unset
+	CitationStyle               CitationStyle                //how citations are marked, in the text and the link lines alike (default CitationStyleNumbered)
+	OutputFormat                OutputFormat                 //the kind of text rendered (default OutputFormatGemtext)
+	LinkStyle                   LinkStyle                    //how links are rendered (default LinkStyleCitation), always inline in plain text
+	LinkLineSeparator           string                       //whitespace between the URL of a link line and its text, such as a tab to line them up (default " ")
+	OmitLinkDisplay             bool                         //list cited links without their text, as just the URL and the marker of any CitationStyle, that in the text telling them apart
+	CompactLinkRuns             bool                         //emit three or more links in a row, with just spacing or punctuation between them as in a menu, as a block of link lines
+	LinkEmitFrequency           int                          //emit gathered links after approximately every n paras (otherwise when new heading, or blockquote)
+	NumberedLinks               bool                         //Deprecated: set CitationStyle, which is the only setting read unless it is left unset
+	EmitImagesAsLinks           bool                         //emit referenced images as links e.g. <img src=href>
+	OmitImages                  bool                         //leave out images altogether, alt text and all, along with links that only wrap an image
+	AnnotateDownloads           bool                         //mark links to files, having a download attribute or the extension of a file such as .pdf or .zip, with DownloadMarker
+	DownloadMarker              string                       //marker after the text of a link to a file, with %s standing for its extension, or "file" if it has none (default "(%s)")
+	ImageMarkerPrefix           string                       //prefix when emitting images
+	EmptyLinkPrefix             string                       //text of links with nothing else to name them, such as around an image without alt text (e.g. <a href=foo><img src=bar></a>)
+	ListItemToLinkWordThreshold int                          //max number of words in a list item having a single link that is converted to a plain gemini link
+	EmphasisMarker              string                       //marker placed either side of emphasised text (<em>, <i>)
+	InlineCodeMarker            string                       //marker placed either side of inline code (<code>, <kbd>, <samp>, <var> outside of <pre>)
+	HorizontalRuleText          string                       //line emitted for a horizontal rule (<hr>), omitted when empty
+	DefinitionIndent            string                       //indent for each level of definition (<dd>) in a definition list
+	ListIndent                  string                       //indent for each level of nesting of list items
+	BaseURL                     string                       //URL that relative links are resolved against, overridden by any <base href> in the document
+	DeduplicateLinks            bool                         //reuse the citation of a link already seen rather than listing it again
+	LinkRewriter                func(string) string          //rewrites each link and image url, returning "" to omit the link
+	MaxDataURILength            int                          //data: URIs longer than this are omitted (default 1024 if zero, negative for no limit); javascript: links are always omitted
+	BulletMarker                string                       //marker for items of unordered lists (default "* ")
+	HeadingPrefixes             []string                     //prefixes for headings <h1> to <h3>, with defaults used for any missing levels
+	WrapWidth                   int                          //wrap text lines longer than this on word boundaries, 0 for no wrapping but of quoted text, which is broken at 74 columns after the quote marker
+	BoldMarker                  string                       //marker placed either side of bold text (<b>, <strong>), the text being left as it is when empty (default "*")
+	StrikethroughMarker         string                       //marker placed either side of struck through text (<del>, <s>, <strike>)
+	InsertionMarker             string                       //marker placed either side of inserted text (<ins>), the text being left as it is when empty
+	PriceReplacementArrow       string                       //text between a struck out price and the inserted one replacing it, such as "→" for "$99 → $59", in place of their markers (unused if empty)
+	HighlightMarker             string                       //marker placed either side of highlighted text (<mark>), the text being left as it is when empty
+	RubyStyle                   RubyStyle                    //how the readings of ruby annotations (<rt>) are rendered (default RubyStyleParentheses)
+	SuperscriptFallback         string                       //marker placed before superscript text that has no unicode superscript form
+	SubscriptFallback           string                       //marker placed before subscript text that has no unicode subscript form
+	TableCaptionBelow           bool                         //place the caption of a pretty table below it rather than above
+	TableCaptionInFence         bool                         //place the caption of a pretty table inside its preformatted fence
+	TableStyle                  TableStyle                   //how pretty tables are rendered (default TableStyleASCII)
+	EmitMediaAsLinks            bool                         //emit video and audio as links to their source, rather than their fallback content
+	EmitIframesAsLinks          bool                         //emit embedded content (<iframe>) as links to its source
+	SummaryPrefix               string                       //prefix for the summary line of a collapsible section (<details>)
+	RespectInlineDisplayNone    bool                         //omit elements styled inline with display:none or visibility:hidden
+	RespectAria                 bool                         //omit decorative content: elements marked aria-hidden="true" and images with a presentation role
+	IncludeNav                  bool                         //render navigation (<nav>) rather than omitting it
+	IncludeFooter               bool                         //render footers (<footer>) rather than omitting them
+	NavFooterPlacement          NavFooterPlacement           //where navigation (<nav>) and footers (<footer>) are rendered (default NavFooterDrop)
+	NavigationHeading           string                       //heading of the navigation placed at the end by NavFooterAppendix, none if empty
+	FooterHeading               string                       //heading of the footers placed at the end by NavFooterAppendix, none if empty
+	SkipElements                []string                     //names of elements to omit, with their content (e.g. "aside")
+	SkipClosedDialogs           bool                         //omit dialog boxes (<dialog>) that are not open, with their content
+	SkipClasses                 []string                     //classes of elements to omit, with their content (e.g. "cookie-banner")
+	SkipIDs                     []string                     //ids of elements to omit, with their content
+	ElementHandlers             map[atom.Atom]ElementHandler //custom rendering of elements, keyed by atom (0 for elements without one, such as custom elements)
+	ExpandAbbreviations         bool                         //follow the first use of each abbreviation (<abbr>) with its title in brackets
+	QuoteMarks                  []string                     //opening and closing marks of inline quotes (<q>), a pair for each level of nesting, used in turn
+	QuoteCiteLinks              bool                         //emit the cite attribute of inline quotes as links
+	BlockquotePrefix            string                       //marker repeated for each level of blockquote, e.g. ">" for ">> " or "> " for "> > " (default ">")
+	KeepFragmentLinks           bool                         //keep links to fragments of the same page (e.g. href="#section") even when there is no base URL to resolve them against
+	GenerateTOC                 bool                         //emit a table of contents, an outline of the headings <h1> to <h6>
+	TOCAtTop                    bool                         //place the table of contents before the text rather than after it
+	Charset                     string                       //the character encoding of the input (e.g. "windows-1252"), detected from the document if empty
+	PromoteTitleToHeading       bool                         //emit the document <title> as a level 1 heading at the top, if the document has no <h1>
+	CheckedTaskMarker           string                       //marker after the bullet of a list item starting with a checked checkbox, as in a task list
+	UncheckedTaskMarker         string                       //marker after the bullet of a list item starting with an unchecked checkbox
+	QuoteAttributionPrefix      string                       //prefix of the attribution of a quote, from the <figcaption> of a <figure> around a <blockquote>
+	CitationMarkerFormat        string                       //template for citation markers and link numbers, with %d standing for the number, e.g. "(%d)"
+	CitationsAtEndOnly          bool                         //emit all the gathered links once, at the very end, rather than after every few paragraphs and at headings; it wins over CitationsPerSection, whose numbering then runs on, and puts the links of NavFooterAppendix in the same list
+	CitationsPerSection         bool                         //restart the numbering of citations at each heading up to CitationSectionLevel
+	CitationSectionLevel        int                          //the lowest level of heading that starts a section, when numbering per section (default 1)
+	MediaLinkPrefix             string                       //text after the URL in the link lines of images, video and audio, to tell them from links to pages
+	GroupMediaLinks             bool                         //list the links to images, video and audio in a block of their own, after the other links
+	PreferTitleAttribute        bool                         //use the title attribute of a link, when it has one, as the text of its link line
+	MaxConsecutiveBreaks        int                          //the most <br> elements in a row that each break the line, so 3 allows two blank lines (default 2)
+	CompactPre                  bool                         //leave out the blank lines around preformatted text (<pre>)
+	FormattingInHeadings        bool                         //keep the markers of inline formatting, such as emphasis and inline code, in heading lines
+	AddressPrefix               string                       //prefix of the contact details in an <address>
+	AsidePrefix                 string                       //prefix of tangential content (<aside>), set apart as a block of its own
+	EmphasizeAddress            bool                         //mark the contact details in an <address> as emphasised text
+	ImageAltOnly                bool                         //emit just the alt text of images, without a marker or link, leaving out images with an empty alt or a presentation role
+	LazyImageAttrs              []string                     //attributes holding the real URL of a lazy loaded image, used when its src is missing or a placeholder
+	MaxDepth                    int                          //the deepest nesting of elements rendered, beyond which ErrMaxDepth is returned (default 1000 if zero, negative for no limit)
+	TruncateAtMaxDepth          bool                         //leave out anything nested beyond MaxDepth, instead of returning ErrMaxDepth
+	MaxOutputSize               int                          //the most bytes of text rendered, beyond which ErrMaxOutputSize is returned (no limit if zero)
+	TruncateAtMaxOutputSize     bool                         //cut the output short at MaxOutputSize, ending it with an ellipsis, instead of returning ErrMaxOutputSize
+	DisableInlineFormatting     bool                         //leave out the markers of inline formatting, such as emphasis and inline code, keeping just the text
+	NormalizePunctuation        bool                         //replace typographic quotes, dashes and ellipses in the text with their ASCII equivalents, except in preformatted text and code
+	NormalizeNBSP               bool                         //replace non-breaking spaces in the text with ordinary spaces, so they collapse and lines can break at them
+	StripInvisibleCharacters    bool                         //remove zero-width spaces, joiners and soft hyphens from the text
+}
+
+// ElementHandler renders node in place of the built-in handling of the element,
+// returning handled as false to fall back to it. Handlers write output using the
+// Emit, EmitChildren and EmitLink methods of ctx.
+type ElementHandler func(ctx *TextifyTraverseContext, node *html.Node) (handled bool, err error)
+
+// TableStyle selects how tables are rendered when PrettyTables is on.
+type TableStyle int
+
+const (
+	TableStyleASCII    TableStyle = iota // an ASCII table inside a preformatted fence
+	TableStyleMarkdown                   // a Markdown style pipe table, not fenced
+)
+
+// NavFooterPlacement selects where navigation and footers are rendered.
+type NavFooterPlacement int
+
+const (
+	NavFooterDrop     NavFooterPlacement = iota // left out, unless IncludeNav or IncludeFooter is set
+	NavFooterInline                             // rendered where they are in the document
+	NavFooterAppendix                           // rendered after the text, under NavigationHeading and FooterHeading
+)
+
+// OutputFormat selects the kind of text rendered.
+type OutputFormat int
+
+const (
+	OutputFormatGemtext   OutputFormat = iota // gemtext, with heading, list and link lines
+	OutputFormatPlainText                     // plain text, with unmarked headings, dashes for bullets and the URLs of links in brackets
+)
+
+// CitationStyle selects how citations are marked, the marker in the text matching the
+// one in the link line. Left unset, as in an Options made other than by NewOptions, it
+// is CitationStyleNumbered if either of the deprecated CitationMarkers and NumberedLinks
+// is set, and CitationStyleNone otherwise.
+type CitationStyle int
+
+const (
+	CitationStyleNone     CitationStyle = iota + 1 // no markers, in the text or the link lines
+	CitationStyleNumbered                          // numbered markers, such as [1]
+	CitationStyleSymbol                            // footnote symbols, such as [*] and [†], doubled once they run out
+)
+
+// citationSymbols mark citations in CitationStyleSymbol, in order.
+var citationSymbols = []string{"*", "†", "‡", "§", "‖", "¶"}
+
+// RubyStyle selects how the readings of ruby annotations are rendered.
+type RubyStyle int
+
+const (
+	RubyStyleParentheses RubyStyle = iota // in brackets after the base text, as in 漢(kan)
+	RubyStyleOmit                         // left out, keeping just the base text
+)
+
+// plainTextBulletMarker marks the items of unordered lists in plain text.
+const plainTextBulletMarker = "- "
+
+// LinkStyle selects how links are rendered.
+type LinkStyle int
+
+const (
+	LinkStyleCitation          LinkStyle = iota // a citation marker in the text, with the links listed every few paragraphs
+	LinkStyleInline                             // the URL in brackets in the text, after the link, with no link lines
+	LinkStyleFootnoteImmediate                  // link lines straight after each paragraph, with no citation markers or numbers
+)
+
+var defaultHeadingPrefixes = []string{"# ", "## ", "### "}
+
+var defaultQuoteMarks = []string{"“", "”", "‘", "’"}
+
+var defaultLazyImageAttrs = []string{"data-src", "data-original", "data-lazy-src"}
+
+const defaultCitationMarkerFormat = "[%d]"
+
+const defaultDownloadMarker = "(%s)"
+
+// defaultIframeLabel labels the link to embedded content that has no title or name.
+const defaultIframeLabel = "embedded content"
+
+// blankLineMark marks a blank line that is to be kept rather than collapsed with the
+// others around it. The parser replaces any NUL in the document, so it cannot clash.
+const (
+	blankLineRune = '\x00'
+	blankLineMark = string(blankLineRune)
+)
+
+// fenceMark ends the fence lines to be left out of plain text, telling them from any
+// text that happens to start like one. It is a noncharacter, which Unicode sets aside
+// for such internal use rather than for text.
+const fenceMark = "\uFDD0"
+
+//NewOptions creates Options with default settings, then applies any opts to them
+func NewOptions(opts ...Option) *Options {
+	options := &Options{
 		PrettyTables:                false,
 		PrettyTablesOptions:         NewPrettyTablesOptions(),
 		OmitLinks:                   false,
 		CitationStart:               1,
-		CitationMarkers:             true,
-		NumberedLinks:               true,
+		CitationStyle:               CitationStyleNumbered,
 		LinkEmitFrequency:           2,
 		EmitImagesAsLinks:           true,
+		RespectAria:                 true,
 		ImageMarkerPrefix:           "‡",
 		EmptyLinkPrefix:             ">>",
 		ListItemToLinkWordThreshold: 30,
+		EmphasisMarker:              "*",
+		InlineCodeMarker:            "`",
+		HorizontalRuleText:          "---",
+		DefinitionIndent:            "  ",
+		ListIndent:                  "  ",
+		BulletMarker:                "* ",
+		HeadingPrefixes:             append([]string(nil), defaultHeadingPrefixes...),
+		BoldMarker:                  "*",
+		StrikethroughMarker:         "~~",
+		HighlightMarker:             "==",
+		SuperscriptFallback:         "^",
+		SubscriptFallback:           "_",
+		EmitMediaAsLinks:            true,
+		EmitIframesAsLinks:          true,
+		SummaryPrefix:               "▸ ",
+		QuoteMarks:                  append([]string(nil), defaultQuoteMarks...),
+		BlockquotePrefix:            ">",
+		CheckedTaskMarker:           "[x] ",
+		UncheckedTaskMarker:         "[ ] ",
+		QuoteAttributionPrefix:      "— ",
+		AsidePrefix:                 "Aside: ",
+		NavigationHeading:           "Navigation",
+		FooterHeading:               "Footer",
+		CitationMarkerFormat:        defaultCitationMarkerFormat,
+		DownloadMarker:              defaultDownloadMarker,
+		LazyImageAttrs:              append([]string(nil), defaultLazyImageAttrs...),
+		MaxDepth:                    defaultMaxDepth,
+		MaxDataURILength:            defaultMaxDataURILength,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// Option changes a setting of Options, for use with NewOptions.
+type Option func(*Options)
+
+// WithPrettyTables renders tables as text tables, with the given style.
+func WithPrettyTables(style TableStyle) Option {
+	return func(o *Options) {
+		o.PrettyTables = true
+		o.TableStyle = style
+	}
+}
+
+// WithOmitLinks leaves out all links.
+func WithOmitLinks() Option {
+	return func(o *Options) {
+		o.OmitLinks = true
+	}
+}
+
+// WithOutputFormat renders the given kind of text.
+func WithOutputFormat(format OutputFormat) Option {
+	return func(o *Options) {
+		o.OutputFormat = format
+	}
+}
+
+// WithLinkStyle renders links in the given style.
+func WithLinkStyle(style LinkStyle) Option {
+	return func(o *Options) {
+		o.LinkStyle = style
+	}
+}
+
+// WithCitationStyle marks citations in the given style.
+func WithCitationStyle(style CitationStyle) Option {
+	return func(o *Options) {
+		o.CitationStyle = style
+	}
+}
+
+// WithCitationStart numbers the citations from n.
+func WithCitationStart(n int) Option {
+	return func(o *Options) {
+		o.CitationStart = n
+	}
+}
+
+// WithLinkEmitFrequency emits the gathered links after about every n paragraphs.
+func WithLinkEmitFrequency(n int) Option {
+	return func(o *Options) {
+		o.LinkEmitFrequency = n
+	}
+}
+
+// WithCitationsAtEndOnly emits all the gathered links once, at the end.
+func WithCitationsAtEndOnly() Option {
+	return func(o *Options) {
+		o.CitationsAtEndOnly = true
+	}
+}
+
+// WithWrapWidth wraps text lines at the given width.
+func WithWrapWidth(width int) Option {
+	return func(o *Options) {
+		o.WrapWidth = width
+	}
+}
+
+// WithBaseURL resolves relative links against base.
+func WithBaseURL(base string) Option {
+	return func(o *Options) {
+		o.BaseURL = base
+	}
+}
+
+// WithLinkRewriter rewrites each link URL with rewrite.
+func WithLinkRewriter(rewrite func(string) string) Option {
+	return func(o *Options) {
+		o.LinkRewriter = rewrite
 	}
 }
 
@@ -91,18 +384,25 @@ func NewPrettyTablesOptions() *PrettyTablesOptions {
 
 // FlushCitations emits a list of Gemini links gathered up to this point, if the para count exceeds the
 // emit frequency
-func (ctx *TextifyTraverseContext) CheckFlushCitations() {
+func (ctx *TextifyTraverseContext) CheckFlushCitations() error {
 
 	//	if ctx.linkAccumulator.emitParaCount > ctx.options.LinkEmitFrequency &&  ctx.citationCount > 0 {
-	if ctx.linkAccumulator.emitParaCount > ctx.options.LinkEmitFrequency && len(ctx.linkAccumulator.linkArray) > (ctx.linkAccumulator.flushedToIndex+1) {
-		ctx.FlushCitations()
-	} else {
-		ctx.linkAccumulator.emitParaCount += 1
+	if ctx.linkStyle() == LinkStyleFootnoteImmediate {
+		//the links of whatever came before go straight after it
+		return ctx.FlushCitations()
+	} else if ctx.linkAccumulator.emitParaCount > ctx.options.LinkEmitFrequency && len(ctx.linkAccumulator.linkArray) > (ctx.linkAccumulator.flushedToIndex+1) {
+		return ctx.FlushCitations()
 	}
+	ctx.linkAccumulator.emitParaCount += 1
+	return nil
 }
 
-func (ctx *TextifyTraverseContext) FlushCitations() {
-	ctx.emitGeminiCitations()
+func (ctx *TextifyTraverseContext) FlushCitations() error {
+	if ctx.options.CitationsAtEndOnly {
+		//the links are all emitted together at the end
+		return nil
+	}
+	return ctx.emitGeminiCitations()
 }
 
 func (ctx *TextifyTraverseContext) ResetCitationCounters() {
@@ -112,508 +412,3007 @@ func (ctx *TextifyTraverseContext) ResetCitationCounters() {
 
 // FromHTMLNode renders text output from a pre-parsed HTML document.
 func FromHTMLNode(doc *html.Node, ctx TextifyTraverseContext) (string, error) {
+	return ctx.Render(doc)
+}
 
-	if err := ctx.traverse(doc); err != nil {
+// Render renders text output from a pre-parsed HTML document with ctx itself, rather
+// than a copy of it as the other functions do, so that afterwards ctx holds the links
+// found. Reset ctx before rendering another document with it.
+func (ctx *TextifyTraverseContext) Render(doc *html.Node) (string, error) {
+	buf := &strings.Builder{}
+	if err := ctx.render(doc, &gemtextWriter{w: buf}, false); err != nil {
 		return "", err
 	}
-	//flush any remaining citations at the end
-	ctx.forceFlushGeminiCitations()
-
-	text := strings.TrimSpace(newlineRe.ReplaceAllString(
-		strings.Replace(ctx.buf.String(), "\n ", "\n", -1), "\n\n"),
-	)
-
-	//somewhat hacky tidying up of start and end of blockquotes
-	startQuote := regexp.MustCompile(`\n *\n+> \n`)
-	text = startQuote.ReplaceAllString(text, "\n\n")
-	endQuote := regexp.MustCompile(`\n> \n\n+`)
-	text = endQuote.ReplaceAllString(text, "\n\n")
-	text = endQuote.ReplaceAllString(text, "\n\n")
-
-	return text, nil
+	return buf.String(), nil
 }
 
-// FromReader renders text output after parsing HTML for the specified
-// io.Reader.
-func FromReader(reader io.Reader, ctx TextifyTraverseContext) (string, error) {
-	newReader, err := bom.NewReaderWithoutBom(reader)
-	if err != nil {
-		return "", err
-	}
-	doc, err := html.Parse(newReader)
-	if err != nil {
-		return "", err
+// LinksFromHTMLNode renders text output from a pre-parsed HTML document, also
+// returning the links found in it, in document order.
+func LinksFromHTMLNode(doc *html.Node, ctx TextifyTraverseContext) ([]Link, string, error) {
+	buf := &strings.Builder{}
+	if err := ctx.render(doc, &gemtextWriter{w: buf}, false); err != nil {
+		return nil, "", err
 	}
+	return ctx.Links(), buf.String(), nil
+}
 
-	return FromHTMLNode(doc, ctx)
+// Result is the outcome of rendering a document, with some statistics about it.
+type Result struct {
+	Text         string
+	Links        []Link // the links found, in document order
+	ImageCount   int    // number of <img> elements rendered
+	TableCount   int    // number of <table> elements rendered, including nested ones
+	HeadingCount int    // number of headings <h1> to <h6> rendered
 }
 
-// FromString parses HTML from the input string, then renders the text form.
-func FromString(input string, ctx TextifyTraverseContext) (string, error) {
-	bs := bom.CleanBom([]byte(input))
-	text, err := FromReader(bytes.NewReader(bs), ctx)
-	if err != nil {
-		return "", err
+// ResultFromHTMLNode renders text output from a pre-parsed HTML document, along
+// with the links found in it and counts of some of its elements.
+func ResultFromHTMLNode(doc *html.Node, ctx TextifyTraverseContext) (Result, error) {
+	buf := &strings.Builder{}
+	if err := ctx.render(doc, &gemtextWriter{w: buf}, false); err != nil {
+		return Result{}, err
 	}
-	return text, nil
+	return Result{
+		Text:         buf.String(),
+		Links:        ctx.Links(),
+		ImageCount:   ctx.counts.images,
+		TableCount:   ctx.counts.tables,
+		HeadingCount: ctx.counts.headings,
+	}, nil
 }
 
-var (
-	spacingRe = regexp.MustCompile(`[ \r\n\t]+`)
-	newlineRe = regexp.MustCompile(`\n\n+`)
-)
-
-// traverseTableCtx holds text-related context.
-type TextifyTraverseContext struct {
-	buf bytes.Buffer
+// TitleFromHTMLNode returns the title of a pre-parsed HTML document, from its <title>
+// element, or the empty string if it has none.
+func TitleFromHTMLNode(doc *html.Node) (string, error) {
+	title := findElement(doc, atom.Title)
+	if title == nil {
+		return "", nil
+	}
 
-	prefix          string
-	tableCtx        tableTraverseContext
-	options         Options
-	endsWithSpace   bool
-	justClosedDiv   bool
-	blockquoteLevel int
-	lineLength      int
-	isPre           bool
-	linkAccumulator linkAccumulatorType
+	text := &strings.Builder{}
+	for c := title.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.TextNode {
+			text.WriteString(c.Data)
+		}
+	}
+	return strings.TrimSpace(spacingRe.ReplaceAllString(text.String(), " ")), nil
 }
 
-type linkAccumulatorType struct {
-	emitParaCount  int
-	linkArray      []citationLink
-	flushedToIndex int
-	tableNestLevel int
-}
+// imageSource returns the URL of the image to link to for an <img>: the largest
+// candidate of the first <source> of a surrounding <picture>, or else of the image's
+// own srcset, falling back to its src. If the src is missing or a placeholder, the
+// attributes used by lazy loading scripts are looked at first.
+func (ctx *TextifyTraverseContext) imageSource(img *html.Node) string {
+	if picture := img.Parent; picture != nil && picture.DataAtom == atom.Picture {
+		for c := picture.FirstChild; c != nil && c != img; c = c.NextSibling {
+			if c.DataAtom == atom.Source {
+				if src := bestSrcsetCandidate(getAttrVal(c, "srcset")); src != "" {
+					return src
+				}
+			}
+		}
+	}
+	if src := bestSrcsetCandidate(getAttrVal(img, "srcset")); src != "" {
+		return src
+	}
 
-func newlinkAccumulator() *linkAccumulatorType {
-	return &linkAccumulatorType{
-		flushedToIndex: -1,
+	src := getAttrVal(img, "src")
+	if isPlaceholderImage(src) {
+		for _, attr := range ctx.options.LazyImageAttrs {
+			lazySrc := strings.TrimSpace(getAttrVal(img, attr))
+			if strings.HasSuffix(attr, "srcset") {
+				lazySrc = bestSrcsetCandidate(lazySrc)
+			}
+			if lazySrc != "" {
+				return lazySrc
+			}
+		}
 	}
+	return src
 }
 
-type citationLink struct {
-	index   int
-	url     string
-	display string
+// isPlaceholderImage reports whether an image src is missing, or looks like it stands
+// in for the real image until that is loaded.
+func isPlaceholderImage(src string) bool {
+	src = strings.TrimSpace(src)
+	return src == "" || hasScheme(src, "data") || placeholderImageRe.MatchString(filepath.Base(src))
 }
 
-// tableTraverseContext holds table ASCII-form related context.
-type tableTraverseContext struct {
-	header     []string
-	body       [][]string
-	footer     []string
-	tmpRow     int
-	isInFooter bool
-}
+// bestSrcsetCandidate returns the URL of the image candidate in a srcset attribute
+// with the greatest width, or failing that the greatest pixel density, or the empty
+// string if there are none.
+func bestSrcsetCandidate(srcset string) string {
+	best, bestWidth, bestDensity := "", 0.0, 0.0
+	for srcset != "" {
+		//each candidate is a URL, which may itself contain commas, then any descriptor
+		srcset = strings.TrimLeft(srcset, " \t\r\n\f,")
+		end := strings.IndexAny(srcset, " \t\r\n\f")
+		if end < 0 {
+			end = len(srcset)
+		}
+		candidate, descriptor := srcset[:end], ""
+		srcset = srcset[end:]
+		if strings.HasSuffix(candidate, ",") {
+			candidate = strings.TrimRight(candidate, ",")
+		} else {
+			end = strings.IndexByte(srcset, ',')
+			if end < 0 {
+				end = len(srcset)
+			}
+			descriptor, srcset = strings.TrimSpace(srcset[:end]), srcset[end:]
+		}
+		if candidate == "" {
+			continue
+		}
 
-func (tableCtx *tableTraverseContext) init() {
-	tableCtx.body = [][]string{}
-	tableCtx.header = []string{}
-	tableCtx.footer = []string{}
-	tableCtx.isInFooter = false
-	tableCtx.tmpRow = 0
+		width, density := 0.0, 1.0
+		if n, err := strconv.ParseFloat(strings.TrimRight(descriptor, "wx"), 64); err == nil && len(descriptor) > 1 {
+			if strings.HasSuffix(descriptor, "w") {
+				width = n
+			} else if strings.HasSuffix(descriptor, "x") {
+				density = n
+			}
+		}
+		if best == "" || width > bestWidth || (width == bestWidth && density > bestDensity) {
+			best, bestWidth, bestDensity = candidate, width, density
+		}
+	}
+	return best
 }
 
-func NewTraverseContext(options Options) *TextifyTraverseContext {
+// findElement returns the first HTML element of the given type within node, in
+// document order, or nil if there is none.
+func findElement(node *html.Node, a atom.Atom) *html.Node {
+	if node.Type == html.ElementNode && node.DataAtom == a && node.Namespace == "" {
+		return node
+	}
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if found := findElement(c, a); found != nil {
+			return found
+		}
+	}
+	return nil
+}
 
-	//no options provided we need to set some default options for non-zero
-	//types.
+// FromReader renders text output after parsing HTML for the specified
+// io.Reader.
+func FromReader(reader io.Reader, ctx TextifyTraverseContext) (string, error) {
+	doc, err := parseReader(reader, ctx.options.Charset)
+	if err != nil {
+		return "", err
+	}
 
-	//start links at 1, not 0 if not specified
-	options.CitationStart = 1 //otherwise uses zero value which is 0
+	return FromHTMLNode(doc, ctx)
+}
 
-	var ctx = TextifyTraverseContext{
-		buf:     bytes.Buffer{},
-		options: options,
+// FromReaderContext renders text output after parsing HTML for the specified
+// io.Reader, giving up with the context's error if it is cancelled or times out
+// before rendering is done.
+func FromReaderContext(ctx context.Context, reader io.Reader, tctx TextifyTraverseContext) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	doc, err := parseReader(reader, tctx.options.Charset)
+	if err != nil {
+		return "", err
 	}
 
-	ctx.linkAccumulator = *newlinkAccumulator()
-
-	return &ctx
+	tctx.cancel = ctx
+	return FromHTMLNode(doc, tctx)
 }
-func (ctx *TextifyTraverseContext) handleElement(node *html.Node) error {
-	ctx.justClosedDiv = false
 
-	prefix := ""
+// FromReaderToWriter renders text output after parsing HTML for the specified
+// io.Reader, writing it to w as the document is traversed instead of returning it
+// in one piece.
+func FromReaderToWriter(reader io.Reader, w io.Writer, ctx TextifyTraverseContext) error {
+	doc, err := parseReader(reader, ctx.options.Charset)
+	if err != nil {
+		return err
+	}
 
-	switch node.DataAtom {
-	case atom.Footer, atom.Nav:
-		return nil
+	return ctx.render(doc, &gemtextWriter{w: w}, true)
+}
 
-	case atom.Br:
-		return ctx.emit("\n")
+// parseReader parses the HTML read from reader, decoding it to UTF-8 from the given
+// charset, or else from the one given by a byte order mark or <meta> in the document.
+// Input that is valid UTF-8 is taken as such unless a byte order mark says otherwise.
+func parseReader(reader io.Reader, label string) (*html.Node, error) {
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	return parseBytes(content, label)
+}
 
-	case atom.H1, atom.H2, atom.H3:
+// parseBytes is parseReader for HTML already read, which is parsed where it is.
+func parseBytes(content []byte, label string) (*html.Node, error) {
+	content = bom.CleanBom(content)
 
-		if node.DataAtom == atom.H1 {
-			ctx.FlushCitations()
-			prefix = "# "
+	var input io.Reader = bytes.NewReader(content)
+	if label == "" {
+		if _, name, certain := charset.DetermineEncoding(content, ""); name != "utf-8" && (certain || !utf8.Valid(content)) {
+			label = name
 		}
-		if node.DataAtom == atom.H2 {
-			ctx.FlushCitations()
-			prefix = "## "
+	}
+	if label != "" {
+		decoded, err := charset.NewReaderLabel(label, input)
+		if err != nil {
+			return nil, err
 		}
+		input = decoded
+	}
+	return html.Parse(input)
+}
 
-		if node.DataAtom == atom.H3 {
-			ctx.FlushCitations()
-			prefix = "### "
-		}
+// render traverses the document and writes the output to out, either as it goes
+// when streaming, or all at once at the end.
+func (ctx *TextifyTraverseContext) render(doc *html.Node, out *gemtextWriter, streaming bool) error {
+	ctx.out = nil
+	if streaming {
+		ctx.out = out
+	}
+	out.wrapWidth = ctx.options.WrapWidth
+	out.plainText = ctx.options.OutputFormat == OutputFormatPlainText
+	out.pipeTables = ctx.options.TableStyle == TableStyleMarkdown
 
-		ctx.emit("\n\n" + prefix)
-		if err := ctx.traverseChildren(node); err != nil {
-			return err
-		}
-		return ctx.emit("\n\n")
+	if err := ctx.initBaseURL(doc); err != nil {
+		return err
+	}
 
-	case atom.Blockquote:
-		ctx.FlushCitations()
-		//if err := ctx.emit("\n"); err != nil {
-		//	return err
-		//}
-		ctx.blockquoteLevel++
-		ctx.prefix = strings.Repeat(">", ctx.blockquoteLevel) + " "
-		//if ctx.blockquoteLevel == 1 {
-		//	if err := ctx.emit("\n"); err != nil {
-		//		return err
-		//	}
-		//}
-		if err := ctx.traverseChildren(node); err != nil {
+	if err := ctx.renderDocument(doc); err == errOutputTruncated {
+		ctx.truncateOutput()
+	} else if err != nil {
+		return err
+	}
+	return out.write(ctx.takeBuffer(), true)
+}
+
+// renderDocument renders the whole of the document, with any title, table of contents
+// and citations, to the buffer.
+func (ctx *TextifyTraverseContext) renderDocument(doc *html.Node) error {
+	if ctx.options.PromoteTitleToHeading && findElement(doc, atom.H1) == nil {
+		title, err := TitleFromHTMLNode(doc)
+		if err != nil {
 			return err
 		}
-		ctx.blockquoteLevel--
-		ctx.prefix = strings.Repeat(">", ctx.blockquoteLevel)
-		if ctx.blockquoteLevel > 0 {
-			ctx.prefix += " "
-		}
-		//return ctx.emit("\n\n")
-		return ctx.emit("")
-
-	case atom.Div:
-
-		if ctx.lineLength > 0 {
-			if err := ctx.emit("\n"); err != nil {
+		if title != "" {
+			if err := ctx.emit("\n\n" + ctx.headingPrefix(1) + title + "\n\n"); err != nil {
 				return err
 			}
 		}
-		if err := ctx.traverseChildren(node); err != nil {
-			return err
-		}
-		var err error
-		if !ctx.justClosedDiv {
-			err = ctx.emit("\n")
-		}
-		ctx.justClosedDiv = true
-		return err
-
-	case atom.Li:
+	}
 
-		//a test context to examine the list element to see if it just has a single link
-		//in which case we'll output a link line, or no links in which case we output just a bullet
-		testCtx := TextifyTraverseContext{}
-		if err := testCtx.traverseChildren(node); err != nil {
+	if ctx.options.GenerateTOC && ctx.options.TOCAtTop {
+		//gather the headings first, from the whole document
+		tocCtx := ctx.newTestContext()
+		tocCtx.options.MaxOutputSize = 0
+		if err := tocCtx.traverse(doc); err != nil {
 			return err
 		}
-
-		//if content contains just one link, output a link instead of a bullet if within a specified number of
-		//words
-		maxSingletonLinkLength := ctx.options.ListItemToLinkWordThreshold
-		if (len(strings.Split(testCtx.buf.String(), " ")) < maxSingletonLinkLength) && (len(testCtx.linkAccumulator.linkArray) == 1) {
-			return ctx.emit("=> " + testCtx.linkAccumulator.linkArray[0].url + " " + testCtx.buf.String() + "\n")
-		}
-
-		//if no links, just emit a bullet with the text, ignoring any sub elements
-		if len(testCtx.linkAccumulator.linkArray) == 0 {
-			return ctx.emit("* " + testCtx.buf.String() + "\n")
+		if err := ctx.emitTOC(tocCtx.headings); err != nil {
+			return err
 		}
+	}
 
-		//otherwise is mixed content, so keep traversing
-		if err := ctx.emit("* "); err != nil {
+	if err := ctx.traverse(doc); err != nil {
+		return err
+	}
+	//flush any remaining citations at the end, after the navigation and footers too
+	//when the links are all listed together
+	if !ctx.options.CitationsAtEndOnly {
+		if err := ctx.forceFlushGeminiCitations(); err != nil {
 			return err
 		}
+	}
 
-		if err := ctx.traverseChildren(node); err != nil {
+	if err := ctx.emitAppendix(); err != nil {
+		return err
+	}
+	if ctx.options.CitationsAtEndOnly {
+		if err := ctx.forceFlushGeminiCitations(); err != nil {
 			return err
 		}
+	}
+
+	if ctx.options.GenerateTOC && !ctx.options.TOCAtTop {
+		return ctx.emitTOC(ctx.headings)
+	}
+	return nil
+}
+
+// checkOutputSize returns an error once the text rendered, including any already
+// written out, has grown beyond MaxOutputSize.
+func (ctx *TextifyTraverseContext) checkOutputSize() error {
+	if ctx.options.MaxOutputSize <= 0 || ctx.written+ctx.buf.Len() <= ctx.options.MaxOutputSize {
+		return nil
+	}
+	if ctx.options.TruncateAtMaxOutputSize {
+		return errOutputTruncated
+	}
+	return ErrMaxOutputSize
+}
+
+// truncateOutput cuts the buffer short so that the text rendered fits within
+// MaxOutputSize, ending it with an ellipsis.
+func (ctx *TextifyTraverseContext) truncateOutput() {
+	size := ctx.options.MaxOutputSize - ctx.written
+	if size < 0 {
+		size = 0
+	}
+	if size < ctx.buf.Len() {
+		//not splitting a character
+		text := ctx.buf.Bytes()
+		for size > 0 && !utf8.RuneStart(text[size]) {
+			size--
+		}
+		ctx.buf.Truncate(size)
+		ctx.dropQuoteBreaks(size)
+	}
+	ctx.buf.WriteString(truncationEllipsis)
+}
+
+// streamOutput writes out the text rendered so far when streaming, once enough has
+// accumulated and nothing being rendered still needs to look back at it.
+func (ctx *TextifyTraverseContext) streamOutput() error {
+	if ctx.out == nil || ctx.buf.Len() < streamChunkSize || ctx.inlineLevel > 0 || ctx.linkAccumulator.tableNestLevel > 0 || ctx.blockquoteLevel > 0 {
+		return nil
+	}
+	ctx.written += ctx.buf.Len()
+	return ctx.out.write(ctx.takeBuffer(), false)
+}
+
+func (ctx *TextifyTraverseContext) takeBuffer() string {
+	text := ctx.buf.String()
+	ctx.buf.Reset()
+	ctx.citations = nil //their markers are in the text taken
+	ctx.quoteBreaks = nil
+	return text
+}
+
+// gemtextWriter tidies up rendered text as it is written out, which may be in
+// several chunks.
+type gemtextWriter struct {
+	w          io.Writer
+	wrapWidth  int
+	plainText  bool //leave out the fence lines marked as to be left out of plain text
+	pipeTables bool //tables are unfenced pipe tables, whose rows are not to be wrapped
+	started    bool
+	inPre      bool
+	pending    string //end of the previous chunk, held back as it may need tidying with the next one
+}
+
+// write tidies and writes the text. Unless this is the final chunk, the last line
+// and any blank or quote marker lines before it are held back.
+func (gw *gemtextWriter) write(chunk string, final bool) error {
+	text := gw.pending + chunk
+	if !gw.started {
+		text = strings.TrimLeftFunc(text, isSpacing)
+	}
+
+	var cut int
+	if final {
+		text = strings.TrimRightFunc(text, isSpacing)
+		cut = len(text)
+	} else {
+		cut = strings.LastIndex(strings.TrimRight(text, "\n\t >"), "\n")
+		cut = len(strings.TrimRight(text[:cut+1], "\n\t >"))
+	}
+	gw.pending = text[cut:]
+	if cut == 0 {
+		return nil
+	}
+	gw.started = true
+
+	inPre := gw.inPre
+	fences := fenceRe
+	if gw.plainText {
+		fences = markedFenceRe
+	}
+	text, gw.inPre = tidyText(text[:cut], inPre, fences)
+	if gw.wrapWidth > 0 {
+		text = gw.wrap(text, inPre)
+	}
+	if gw.plainText {
+		text = fenceLineRe.ReplaceAllString(text, "")
+		if final {
+			text = strings.TrimRightFunc(text, unicode.IsSpace)
+		}
+	}
+	_, err := io.WriteString(gw.w, text)
+	return err
+}
+
+// wrap hard-wraps text lines on word boundaries, carrying any quote marker and indent
+// over to the continuation lines. Link lines, headings and preformatted text are left
+// as they are, inPre being whether text starts within preformatted text.
+func (gw *gemtextWriter) wrap(text string, inPre bool) string {
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "```") && (!gw.plainText || strings.HasSuffix(line, fenceMark)) {
+			inPre = !inPre
+			continue
+		}
+		if inPre || strings.HasPrefix(line, "=>") || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if gw.pipeTables && strings.HasPrefix(line[len(wrapPrefixRe.FindString(line)):], "|") {
+			//a row of a pipe table has to stay on one line
+			continue
+		}
+		lines[i] = wrapLine(line, gw.wrapWidth)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// wrapLine hard-wraps a line on word boundaries. It never breaks before a word that
+// would make a continuation line without a prefix into a line of another type, such as
+// a link line.
+func wrapLine(line string, width int) string {
+	if utf8.RuneCountInString(line) <= width {
+		return line
+	}
+
+	prefix := wrapPrefixRe.FindString(line)
+	prefixLength := utf8.RuneCountInString(prefix)
+
+	buf := &strings.Builder{}
+	buf.WriteString(prefix)
+	length, lineStart := prefixLength, true
+	for _, word := range strings.Split(line[len(prefix):], " ") {
+		wordLength := utf8.RuneCountInString(word)
+		if !lineStart && length+1+wordLength > width && (prefix != "" || !startsLineType(word)) {
+			buf.WriteString("\n" + prefix)
+			length, lineStart = prefixLength, true
+		}
+		if lineStart && word == "" {
+			continue
+		}
+		if !lineStart {
+			buf.WriteByte(' ')
+			length++
+		}
+		buf.WriteString(word)
+		length += wordLength
+		lineStart = false
+	}
+	return buf.String()
+}
+
+// startsLineType reports whether a line starting with word would be other than a text
+// line: a link, preformatting toggle, heading, list item or quote line.
+func startsLineType(word string) bool {
+	return strings.HasPrefix(word, "=>") || strings.HasPrefix(word, "```") || strings.HasPrefix(word, "#") ||
+		strings.HasPrefix(word, ">") || word == "*"
+}
+
+// tidyText collapses runs of blank lines and tidies up the blockquote markers, leaving
+// the lines of preformatted text as they are, between the fence lines that fences
+// matches. inPre is whether text starts within preformatted text, and the result
+// whether it ends within it.
+func tidyText(text string, inPre bool, fences *regexp.Regexp) (string, bool) {
+	var sb strings.Builder
+	for text != "" {
+		block, fence := text, ""
+		if loc := fences.FindStringIndex(text); loc != nil {
+			block, fence = text[:loc[0]], text[loc[0]:loc[1]]
+		}
+		text = text[len(block)+len(fence):]
+
+		if !inPre {
+			block = newlineRe.ReplaceAllString(block, "\n\n")
+		}
+		block = strings.ReplaceAll(block, blankLineMark, "")
+		if !inPre {
+			//somewhat hacky tidying up of start and end of blockquotes
+			block = startQuoteRe.ReplaceAllString(block, "\n\n")
+			block = endQuoteRe.ReplaceAllString(block, "\n\n")
+			block = endQuoteRe.ReplaceAllString(block, "\n\n")
+		}
+		sb.WriteString(block)
+		sb.WriteString(fence)
+		if fence != "" {
+			inPre = !inPre
+		}
+	}
+	return sb.String(), inPre
+}
+
+// FromString parses HTML from the input string, then renders the text form.
+func FromString(input string, ctx TextifyTraverseContext) (string, error) {
+	return FromBytes([]byte(input), ctx)
+}
+
+// FromBytes parses HTML from the input bytes, then renders the text form.
+func FromBytes(input []byte, ctx TextifyTraverseContext) (string, error) {
+	doc, err := parseBytes(input, ctx.options.Charset)
+	if err != nil {
+		return "", err
+	}
+
+	return FromHTMLNode(doc, ctx)
+}
+
+var (
+	spacingRe   = regexp.MustCompile(`[ \r\n\t]+`)
+	newlineRe   = regexp.MustCompile(`\n\n+`)
+	lineBreakRe = regexp.MustCompile(`\r?\n`)
+	fenceRe     = regexp.MustCompile("(?m)^```.*$")
+	fenceLineRe = regexp.MustCompile("(?m)^```.*" + fenceMark + "\n?")
+
+	//in plain text, only the fence lines marked as such
+	markedFenceRe = regexp.MustCompile("(?m)^```.*" + fenceMark + "$")
+
+	startQuoteRe = regexp.MustCompile(`\n *\n+> \n`)
+	endQuoteRe   = regexp.MustCompile(`\n> \n\n+`)
+	wrapPrefixRe = regexp.MustCompile(`^(>[> ]*)?[ \t]*`)
+	cellBreakRe  = regexp.MustCompile(`[ \t]*\n[ \t\n]*`)
+
+	placeholderImageRe = regexp.MustCompile(`(?i)(placeholder|blank|spacer|pixel|transparent)[^/]*\.(gif|png|svg|jpe?g|webp)$`)
+)
+
+// punctuationReplacer replaces typographic punctuation with ASCII equivalents.
+var punctuationReplacer = strings.NewReplacer(
+	"“", `"`, "”", `"`, "„", `"`, "‟", `"`,
+	"‘", "'", "’", "'", "‚", "'", "‛", "'",
+	"—", "--", "–", "-", "…", "...",
+)
+
+// invisibleReplacer removes characters that take no space: zero-width spaces and
+// joiners, and soft hyphens.
+var invisibleReplacer = strings.NewReplacer(
+	"\u200b", "", "\u200d", "", "\u2060", "", "\ufeff", "", "\u00ad", "",
+)
+
+// superscripts and subscripts map characters to their unicode superscript and
+// subscript forms.
+var (
+	superscripts = map[rune]rune{
+		'0': '⁰', '1': '¹', '2': '²', '3': '³', '4': '⁴', '5': '⁵', '6': '⁶', '7': '⁷', '8': '⁸', '9': '⁹',
+		'+': '⁺', '-': '⁻', '=': '⁼', '(': '⁽', ')': '⁾',
+		'a': 'ᵃ', 'b': 'ᵇ', 'c': 'ᶜ', 'd': 'ᵈ', 'e': 'ᵉ', 'f': 'ᶠ', 'g': 'ᵍ', 'h': 'ʰ', 'i': 'ⁱ', 'j': 'ʲ',
+		'k': 'ᵏ', 'l': 'ˡ', 'm': 'ᵐ', 'n': 'ⁿ', 'o': 'ᵒ', 'p': 'ᵖ', 'r': 'ʳ', 's': 'ˢ', 't': 'ᵗ', 'u': 'ᵘ',
+		'v': 'ᵛ', 'w': 'ʷ', 'x': 'ˣ', 'y': 'ʸ', 'z': 'ᶻ',
+	}
+	subscripts = map[rune]rune{
+		'0': '₀', '1': '₁', '2': '₂', '3': '₃', '4': '₄', '5': '₅', '6': '₆', '7': '₇', '8': '₈', '9': '₉',
+		'+': '₊', '-': '₋', '=': '₌', '(': '₍', ')': '₎',
+		'a': 'ₐ', 'e': 'ₑ', 'h': 'ₕ', 'i': 'ᵢ', 'j': 'ⱼ', 'k': 'ₖ', 'l': 'ₗ', 'm': 'ₘ', 'n': 'ₙ', 'o': 'ₒ',
+		'p': 'ₚ', 'r': 'ᵣ', 's': 'ₛ', 't': 'ₜ', 'u': 'ᵤ', 'v': 'ᵥ', 'x': 'ₓ',
+	}
+)
+
+// maxColspan and maxRowspan are the largest spans of a table cell, as limited by
+// the HTML specification.
+const (
+	maxColspan = 1000
+	maxRowspan = 65534
+)
+
+// quoteLineWidth is the width, after the quote marker, at which lines of quoted text
+// are broken when WrapWidth does not wrap the output as a whole.
+const quoteLineWidth = 74
+
+// streamChunkSize is the amount of rendered text gathered before it is written out
+// when streaming.
+const streamChunkSize = 4096
+
+// defaultMaxDepth is the greatest depth of nesting rendered when Options.MaxDepth is zero.
+const defaultMaxDepth = 1000
+
+// defaultMaxDataURILength is the longest data: URI linked when Options.MaxDataURILength
+// is zero, that being the longest URL a Gemini request may carry.
+const defaultMaxDataURILength = 1024
+
+// ErrMaxDepth is returned when a document is nested more deeply than Options.MaxDepth,
+// unless Options.TruncateAtMaxDepth is set.
+var ErrMaxDepth = errors.New("html2gemini: document nested too deeply")
+
+// ErrMaxOutputSize is returned when the output of a document grows beyond
+// Options.MaxOutputSize, unless Options.TruncateAtMaxOutputSize is set.
+var ErrMaxOutputSize = errors.New("html2gemini: output too large")
+
+// errOutputTruncated stops the rendering once the output has grown beyond
+// Options.MaxOutputSize and is to be cut short there.
+var errOutputTruncated = errors.New("html2gemini: output truncated")
+
+// truncationEllipsis ends output cut short at Options.MaxOutputSize.
+const truncationEllipsis = "..."
+
+// minLinkRun is the fewest links in a row that CompactLinkRuns emits as a block of link lines.
+const minLinkRun = 3
+
+// cancelCheckInterval is the number of nodes traversed between checks of the cancel context.
+const cancelCheckInterval = 256
+
+// traverseTableCtx holds text-related context.
+type TextifyTraverseContext struct {
+	buf     bytes.Buffer
+	written int //bytes of text already written out, when streaming
+
+	prefix          string
+	tableCtx        tableTraverseContext
+	options         Options
+	endsWithSpace   bool
+	justClosedDiv   bool
+	blockquoteLevel int
+	lineLength      int
+	isPre           bool
+	isCode          bool
+	linkAccumulator linkAccumulatorType
+	listStack       []listLevel
+	definitionLevel int
+	baseURL         *url.URL
+	inlineLevel     int
+	out             *gemtextWriter
+	links           []Link
+	abbreviations   map[string]bool //titles of the abbreviations already expanded
+	quoteLevel      int
+	headings        []tocEntry
+	breakRun        int  //number of consecutive <br> elements
+	inHeading       bool //within a heading line, where formatting may be left out
+	counts          elementCounts
+	cancel          context.Context //checked every so often, to give up rendering once it is done
+	visited         int             //number of nodes traversed, to know when to check cancel
+	depth           int             //depth of nesting of the node being traversed
+	citations       []citationMark  //the citations made, with where their markers went in buf
+	quoteBreaks     []int           //where lines of quoted text were broken to fit, as positions in buf
+	appendix        []*html.Node    //navigation and footers, to be rendered after the text
+	inAppendix      bool            //rendering the appendix
+	hasLinkRun      bool            //a run of links has been emitted as link lines
+}
+
+// elementCounts counts the elements of some kinds that have been rendered.
+type elementCounts struct {
+	images   int
+	tables   int
+	headings int
+}
+
+func (c *elementCounts) add(other elementCounts) {
+	c.images += other.images
+	c.tables += other.tables
+	c.headings += other.headings
+}
+
+// tocEntry is a heading listed in the table of contents.
+type tocEntry struct {
+	level int
+	text  string
+}
+
+// Link is a link found in the document.
+type Link struct {
+	Index   int    // citation number, or 0 when the link was emitted directly as a link line
+	URL     string // normalized URL
+	Display string // link text
+	Media   bool   // whether the link is to the source of an image, video or audio element
+}
+
+// listLevel holds the state of a single, possibly nested, list.
+type listLevel struct {
+	ordered   bool
+	index     int
+	numbering string //type of an ordered list: "1", "a", "A", "i" or "I"
+	reversed  bool   //counting down rather than up
+}
+
+type linkAccumulatorType struct {
+	emitParaCount  int
+	linkArray      []citationLink
+	flushedToIndex int
+	tableNestLevel int
+	urlIndex       map[string]int //citation index of each url, when deduplicating links
+	sectionStart   int            //position in linkArray of the first link of the current section
+}
+
+func newlinkAccumulator() *linkAccumulatorType {
+	return &linkAccumulatorType{
+		flushedToIndex: -1,
+	}
+}
+
+type citationLink struct {
+	index   int
+	url     string
+	display string
+	media   bool //the source of an image, video or audio element
+}
+
+// citationMark is a citation made in the text, with the span of the output its marker
+// takes, if any.
+type citationMark struct {
+	url        string
+	start, end int
+}
+
+// tableTraverseContext holds table ASCII-form related context.
+type tableTraverseContext struct {
+	header     []string
+	body       [][]string
+	footer     []string
+	tmpRow     int
+	isInFooter bool
+	caption    string
+	rowspans   []int  //number of further rows spanned by a cell in each column
+	spanned    []bool //columns of the current row taken by a cell in a previous row
+}
+
+func (tableCtx *tableTraverseContext) init() {
+	tableCtx.body = [][]string{}
+	tableCtx.header = []string{}
+	tableCtx.footer = []string{}
+	tableCtx.isInFooter = false
+	tableCtx.tmpRow = 0
+	tableCtx.caption = ""
+	tableCtx.rowspans = nil
+	tableCtx.spanned = nil
+}
+
+// startRow records the columns of a new row that are spanned by cells from
+// previous rows.
+func (tableCtx *tableTraverseContext) startRow() {
+	tableCtx.spanned = make([]bool, len(tableCtx.rowspans))
+	for i, rows := range tableCtx.rowspans {
+		if rows > 0 {
+			tableCtx.spanned[i] = true
+			tableCtx.rowspans[i]--
+		}
+	}
+}
+
+// skipSpanned leaves any spanned columns at the end of row blank.
+func (tableCtx *tableTraverseContext) skipSpanned(row []string) []string {
+	for len(row) < len(tableCtx.spanned) && tableCtx.spanned[len(row)] {
+		row = append(row, "")
+	}
+	return row
+}
+
+// addCell appends cell to row, leaving blank the columns spanned by cells from
+// previous rows and by the colspan of cell itself.
+func (tableCtx *tableTraverseContext) addCell(row []string, cell string, colspan, rowspan int) []string {
+	row = tableCtx.skipSpanned(row)
+	col := len(row)
+	row = append(row, cell)
+	for i := 1; i < colspan; i++ {
+		row = append(row, "")
+	}
+
+	if rowspan > 1 {
+		for len(tableCtx.rowspans) < col+colspan {
+			tableCtx.rowspans = append(tableCtx.rowspans, 0)
+		}
+		for i := col; i < col+colspan; i++ {
+			tableCtx.rowspans[i] = rowspan - 1
+		}
+	}
+	return row
+}
+
+// padRows gives every non empty row the same number of columns, as differing
+// row lengths misalign the rendered table.
+func (tableCtx *tableTraverseContext) padRows() {
+	columns := len(tableCtx.header)
+	if len(tableCtx.footer) > columns {
+		columns = len(tableCtx.footer)
+	}
+	for _, row := range tableCtx.body {
+		if len(row) > columns {
+			columns = len(row)
+		}
+	}
+
+	pad := func(row []string) []string {
+		if len(row) == 0 {
+			return row
+		}
+		for len(row) < columns {
+			row = append(row, "")
+		}
+		return row
+	}
+	tableCtx.header = pad(tableCtx.header)
+	tableCtx.footer = pad(tableCtx.footer)
+	rows := tableCtx.body[:0]
+	for _, row := range tableCtx.body {
+		if len(row) > 0 {
+			rows = append(rows, pad(row))
+		}
+	}
+	tableCtx.body = rows
+}
+
+// cellSpan returns the value of the span attribute of a table cell, limited to
+// between 1 and max.
+func cellSpan(node *html.Node, attrName string, max int) int {
+	span, err := strconv.Atoi(strings.TrimSpace(getAttrVal(node, attrName)))
+	if err != nil || span < 1 {
+		return 1
+	}
+	if span > max {
+		return max
+	}
+	return span
+}
+
+func NewTraverseContext(options Options) *TextifyTraverseContext {
+
+	//no options provided we need to set some default options for non-zero
+	//types.
+
+	//start links at 1, not 0 if not specified
+	if options.CitationStart == 0 {
+		options.CitationStart = 1 //otherwise uses zero value which is 0
+	}
+
+	//lists need a bullet
+	if options.BulletMarker == "" {
+		options.BulletMarker = "* "
+	}
+
+	//the deprecated settings only stand in for an unset style, and mark both or neither
+	if options.CitationStyle == 0 {
+		options.CitationStyle = CitationStyleNone
+		if options.CitationMarkers || options.NumberedLinks {
+			options.CitationStyle = CitationStyleNumbered
+		}
+	}
+
+	var ctx = TextifyTraverseContext{
+		buf:     bytes.Buffer{},
+		options: options,
+	}
+
+	ctx.linkAccumulator = *newlinkAccumulator()
+
+	return &ctx
+}
+
+// Reset clears the state gathered while rendering a document, keeping the options
+// and the allocated buffer, so that the context can Render another document.
+func (ctx *TextifyTraverseContext) Reset() {
+	buf := ctx.buf
+	buf.Reset()
+
+	*ctx = TextifyTraverseContext{
+		buf:     buf,
+		options: ctx.options,
+	}
+	ctx.linkAccumulator = *newlinkAccumulator()
+}
+
+func (ctx *TextifyTraverseContext) handleElement(node *html.Node) error {
+	ctx.justClosedDiv = false
+
+	if ctx.isHidden(node) || ctx.isSkipped(node) {
+		// Ignore the subtree.
+		return nil
+	}
+
+	if handler := ctx.options.ElementHandlers[node.DataAtom]; handler != nil {
+		if handled, err := handler(ctx, node); handled || err != nil {
+			return err
+		}
+	}
+
+	prefix := ""
+
+	switch node.DataAtom {
+	case atom.Footer, atom.Nav:
+		switch {
+		case ctx.inAppendix || ctx.options.NavFooterPlacement == NavFooterInline:
+			//rendered here
+		case ctx.options.NavFooterPlacement == NavFooterAppendix:
+			//kept for the end
+			ctx.appendix = append(ctx.appendix, node)
+			return nil
+		case (node.DataAtom == atom.Nav && !ctx.options.IncludeNav) || (node.DataAtom == atom.Footer && !ctx.options.IncludeFooter):
+			return nil
+		}
+		return ctx.paragraphHandler(node)
+
+	case atom.Article, atom.Section, atom.Main, atom.Header:
+		//sections of the document are set apart like paragraphs
+		return ctx.paragraphHandler(node)
+
+	case atom.Aside:
+		//tangential content, set apart and marked as such
+		if err := ctx.CheckFlushCitations(); err != nil {
+			return err
+		}
+		if err := ctx.emit("\n\n" + ctx.options.AsidePrefix); err != nil {
+			return err
+		}
+		if err := ctx.traverseChildren(node); err != nil {
+			return err
+		}
+		return ctx.emit("\n\n")
+
+	case atom.Wbr:
+		//a place a long word may break, so the text either side stays joined unless
+		//there is a space between them anyway
+		if !spacedText(node.PrevSibling, false) && !spacedText(node.NextSibling, true) {
+			ctx.endsWithSpace = true
+		}
+		return nil
+
+	case atom.Br:
+		if ctx.isPre {
+			//the text around is verbatim, so just break the line
+			ctx.endsWithSpace = true
+			return ctx.emit("\n")
+		}
+
+		maxBreaks := ctx.options.MaxConsecutiveBreaks
+		if maxBreaks <= 0 {
+			maxBreaks = 2
+		}
+		ctx.breakRun++
+		switch {
+		case ctx.breakRun > maxBreaks:
+			return nil
+		case ctx.breakRun > 2:
+			//mark the extra blank line so that it is not collapsed with the others
+			return ctx.emit(blankLineMark + "\n")
+		default:
+			return ctx.emit("\n")
+		}
+
+	case atom.Hr:
+		if ctx.options.HorizontalRuleText == "" {
+			return nil
+		}
+		return ctx.emit("\n\n" + ctx.options.HorizontalRuleText + "\n\n")
+
+	case atom.H4, atom.H5, atom.H6:
+		ctx.counts.headings++
+		if err := ctx.recordHeading(node); err != nil {
+			return err
+		}
+		if err := ctx.startSection(headingLevel(node)); err != nil {
+			return err
+		}
+		return ctx.traverseChildren(node)
+
+	case atom.H1, atom.H2, atom.H3:
+		ctx.counts.headings++
+		if err := ctx.recordHeading(node); err != nil {
+			return err
+		}
+		if err := ctx.startSection(headingLevel(node)); err != nil {
+			return err
+		}
+
+		if node.DataAtom == atom.H1 {
+			if err := ctx.FlushCitations(); err != nil {
+				return err
+			}
+			prefix = ctx.headingPrefix(1)
+		}
+		if node.DataAtom == atom.H2 {
+			if err := ctx.FlushCitations(); err != nil {
+				return err
+			}
+			prefix = ctx.headingPrefix(2)
+		}
+
+		if node.DataAtom == atom.H3 {
+			if err := ctx.FlushCitations(); err != nil {
+				return err
+			}
+			prefix = ctx.headingPrefix(3)
+		}
+
+		if err := ctx.emit("\n\n" + prefix); err != nil {
+			return err
+		}
+		ctx.inHeading = true
+		err := ctx.traverseChildren(node)
+		ctx.inHeading = false
+		if err != nil {
+			return err
+		}
+		return ctx.emit("\n\n")
+
+	case atom.Blockquote:
+		return ctx.blockquoteHandler(node, nil)
+
+	case atom.Figure:
+		//a pull quote, with its attribution in the caption
+		if quote, caption := quoteFigure(node); quote != nil {
+			return ctx.blockquoteHandler(quote, caption)
+		}
+		return ctx.paragraphHandler(node)
+
+	case atom.Figcaption:
+		//the caption goes on its own line, after or before the figure content
+		if ctx.lineLength > 0 {
+			if err := ctx.emit("\n"); err != nil {
+				return err
+			}
+		}
+		if err := ctx.traverseChildren(node); err != nil {
+			return err
+		}
+		return ctx.emit("\n")
+
+	case atom.Address:
+		//contact details, as a block of their own
+		if err := ctx.CheckFlushCitations(); err != nil {
+			return err
+		}
+		if err := ctx.emit("\n\n" + ctx.options.AddressPrefix); err != nil {
+			return err
+		}
+		marker := ""
+		if ctx.options.EmphasizeAddress {
+			marker = ctx.formattingMarker(ctx.options.EmphasisMarker)
+		}
+		if err := ctx.inlineHandler(node, marker, marker); err != nil {
+			return err
+		}
+		return ctx.emit("\n\n")
+
+	case atom.Details:
+		return ctx.paragraphHandler(node)
+
+	case atom.Dialog:
+		if ctx.options.SkipClosedDialogs && !hasAttr(node, "open") {
+			return nil
+		}
+		return ctx.paragraphHandler(node)
+
+	case atom.Summary:
+		if node.Parent == nil || node.Parent.DataAtom != atom.Details {
+			//a stray summary is just a block of text
+			return ctx.paragraphHandler(node)
+		}
+		//a short heading like line, followed by the details body
+		if ctx.lineLength > 0 {
+			if err := ctx.emit("\n"); err != nil {
+				return err
+			}
+		}
+		if err := ctx.emit(ctx.options.SummaryPrefix); err != nil {
+			return err
+		}
+		if err := ctx.traverseChildren(node); err != nil {
+			return err
+		}
+		return ctx.emit("\n")
+
+	case atom.Div:
+
+		if ctx.lineLength > 0 {
+			if err := ctx.emit("\n"); err != nil {
+				return err
+			}
+		}
+		if err := ctx.traverseChildren(node); err != nil {
+			return err
+		}
+		var err error
+		if !ctx.justClosedDiv {
+			err = ctx.emit("\n")
+		}
+		ctx.justClosedDiv = true
+		return err
+
+	case atom.Li:
+
+		indent := ctx.listIndent()
+		marker := ctx.listItemMarker()
+		task := ctx.taskMarker(node)
+
+		if ctx.isPlainText(node) {
+			//no links, so the bullet and text go straight out
+			if err := ctx.emit(indent + marker + task); err != nil {
+				return err
+			}
+			if err := ctx.traverseChildren(node); err != nil {
+				return err
+			}
+			return ctx.emit("\n")
+		}
+
+		//render the item once, in a child context, to see if it just has a single link
+		//in which case we'll output a link line, or no links in which case we output just a bullet
+		child := ctx.newChildContext()
+		if err := child.emit(indent + marker + task); err != nil {
+			ctx.adoptChildContext(&child)
+			return err
+		}
+		start := child.buf.Len()
+		if err := child.traverseChildren(node); err != nil {
+			ctx.adoptChildContext(&child)
+			return err
+		}
+		text := child.textFrom(start)
+		itemText := strings.TrimSpace(text)
+		if strings.HasPrefix(itemText, "```") {
+			//preformatted text has to start on a line of its own, after the bullet
+			itemText = "\n" + itemText
+		}
+		itemText = task + itemText
+
+		//if content contains just one link, output a link instead of a bullet if within a specified number of
+		//words. Ordered lists keep their number in the link text. A link line has to start with "=>" and
+		//clients drop the spacing before its text, so an indented item keeps its bullet to show its
+		//nesting. Neither a table, a nested list nor a run of link lines can go in a link line, so an item
+		//with any of them is rendered as it is.
+		maxSingletonLinkLength := ctx.options.ListItemToLinkWordThreshold
+		nested := findElement(node, atom.Table) != nil || findElement(node, atom.Ul) != nil || findElement(node, atom.Ol) != nil
+		if (len(strings.Fields(text)) <= maxSingletonLinkLength) && indent == "" && !nested && !child.hasLinkRun {
+			if url, ok := ctx.takeSingleLink(&child); ok {
+				if ctx.inOrderedList() {
+					itemText = marker + itemText
+				}
+				return ctx.emitLinkLine(url, itemText)
+			}
+		}
+
+		//if no links, just emit a bullet with the text, ignoring any sub elements
+		if len(child.citations) == 0 {
+			ctx.adoptTestContext(&child)
+			return ctx.emit(indent + marker + itemText + "\n")
+		}
+
+		//otherwise is mixed content, rendered as it is
+		ctx.adoptChildContext(&child)
+		if ctx.lineLength == 0 {
+			//ended with a nested list
+			return nil
+		}
+		return ctx.emit("\n")
+
+	case atom.Dl:
+		ctx.definitionLevel++
+		err := ctx.paragraphHandler(node)
+		ctx.definitionLevel--
+		return err
+
+	case atom.Dt:
+		//terms sit at the indent of the list, with the definitions beneath them
+		indent := ""
+		if ctx.definitionLevel > 1 {
+			indent = strings.Repeat(ctx.options.DefinitionIndent, ctx.definitionLevel-1)
+		}
+		if ctx.lineLength > 0 {
+			if err := ctx.emit("\n"); err != nil {
+				return err
+			}
+		}
+		if err := ctx.emit(indent); err != nil {
+			return err
+		}
+		marker := ctx.formattingMarker(ctx.options.EmphasisMarker)
+		if err := ctx.inlineHandler(node, marker, marker); err != nil {
+			return err
+		}
+		return ctx.emit("\n")
+
+	case atom.Dd:
+		indent := strings.Repeat(ctx.options.DefinitionIndent, ctx.definitionLevel)
+		if ctx.lineLength > 0 {
+			if err := ctx.emit("\n"); err != nil {
+				return err
+			}
+		}
+		if err := ctx.emit(indent); err != nil {
+			return err
+		}
+		if err := ctx.traverseChildren(node); err != nil {
+			return err
+		}
+		return ctx.emit("\n")
+
+	case atom.B, atom.Strong:
+		marker := ctx.formattingMarker(ctx.options.BoldMarker)
+		return ctx.inlineHandler(node, marker, marker)
+
+	case atom.Del, atom.S, atom.Strike:
+		if ctx.options.PriceReplacementArrow != "" && priceReplacement(node) != nil {
+			//the original price, then the arrow to the one replacing it
+			if err := ctx.traverseChildren(node); err != nil {
+				return err
+			}
+			return ctx.emit(ctx.options.PriceReplacementArrow)
+		}
+		marker := ctx.formattingMarker(ctx.options.StrikethroughMarker)
+		return ctx.inlineHandler(node, marker, marker)
+
+	case atom.Ins:
+		if ctx.options.PriceReplacementArrow != "" && replacedPrice(node) != nil {
+			//the price after the arrow from the one struck out
+			return ctx.traverseChildren(node)
+		}
+		marker := ctx.formattingMarker(ctx.options.InsertionMarker)
+		return ctx.inlineHandler(node, marker, marker)
+
+	case atom.Mark:
+		marker := ctx.formattingMarker(ctx.options.HighlightMarker)
+		return ctx.inlineHandler(node, marker, marker)
+
+	case atom.Rt:
+		if ctx.options.RubyStyle != RubyStyleOmit {
+			//the reading goes straight after its base text
+			endsWithSpace, size := ctx.endsWithSpace, ctx.buf.Len()
+			ctx.endsWithSpace = true
+			if err := ctx.inlineHandler(node, "(", ")"); err != nil {
+				return err
+			}
+			if ctx.buf.Len() == size {
+				//there was no reading after all
+				ctx.endsWithSpace = endsWithSpace
+			}
+		}
+		if rubyContinues(node) {
+			//the next base text runs on from the reading, as there are no spaces in the text
+			ctx.endsWithSpace = true
+		}
+		return nil
+
+	case atom.Rp:
+		//fallback brackets for the reading, which has its own
+		return nil
+
+	case atom.Sup:
+		return ctx.scriptHandler(node, superscripts, ctx.options.SuperscriptFallback)
+
+	case atom.Sub:
+		return ctx.scriptHandler(node, subscripts, ctx.options.SubscriptFallback)
+
+	case atom.Abbr:
+		if err := ctx.traverseChildren(node); err != nil {
+			return err
+		}
+		title := strings.TrimSpace(spacingRe.ReplaceAllString(getAttrVal(node, "title"), " "))
+		if !ctx.options.ExpandAbbreviations || title == "" || ctx.abbreviations[title] {
+			return nil
+		}
+		if ctx.abbreviations == nil {
+			ctx.abbreviations = map[string]bool{}
+		}
+		ctx.abbreviations[title] = true
+		return ctx.emit("(" + title + ")")
+
+	case atom.Q:
+		open, close := ctx.quoteMarks()
+		ctx.quoteLevel++
+		err := ctx.inlineHandler(node, open, close)
+		ctx.quoteLevel--
+		if err != nil {
+			return err
+		}
+		if cite := getAttrVal(node, "cite"); ctx.options.QuoteCiteLinks && cite != "" {
+			return ctx.EmitLink(cite, "source")
+		}
+		return nil
+
+	case atom.Em, atom.I:
+		marker := ctx.formattingMarker(ctx.options.EmphasisMarker)
+		return ctx.inlineHandler(node, marker, marker)
+
+	case atom.Code, atom.Kbd, atom.Samp, atom.Var:
+		//keystrokes, sample output and variables are marked like inline code
+		if ctx.isPre {
+			//already fenced as preformatted text
+			return ctx.traverseChildren(node)
+		}
+		//spaced from the text either side only as in the source, so keys stay as in Ctrl+C
+		endsWithSpace, size := ctx.endsWithSpace, ctx.buf.Len()
+		if prev := node.PrevSibling; prev != nil && prev.Type == html.TextNode && !hasTrailingSpace(prev.Data) {
+			ctx.endsWithSpace = true
+		}
+		isCode := ctx.isCode
+		ctx.isCode = true
+		marker := ctx.formattingMarker(ctx.options.InlineCodeMarker)
+		err := ctx.inlineHandler(node, marker, marker)
+		ctx.isCode = isCode
+		if ctx.buf.Len() == size {
+			//nothing was rendered after all
+			ctx.endsWithSpace = endsWithSpace
+		} else if next := node.NextSibling; next != nil && next.Type == html.TextNode && !hasLeadingSpace(next.Data) {
+			ctx.endsWithSpace = true
+		}
+		return err
+
+	case atom.Img:
+		if ctx.options.OmitImages {
+			return nil
+		}
+		if ctx.options.RespectAria && isPresentational(node) {
+			//decorative, so there is nothing to show
+			return nil
+		}
+		ctx.counts.images++
+		if ctx.options.ImageAltOnly {
+			//just the text alternative, with decorative images left out altogether
+			if isPresentational(node) {
+				return nil
+			}
+			return ctx.emit(strings.TrimSpace(spacingRe.ReplaceAllString(getAttrVal(node, "alt"), " ")))
+		}
 
-		return ctx.emit("\n")
-
-	case atom.Img:
 		//output images with a link to the image
-		hrefLink := ""
-		altText := ""
-		if altText = getAttrVal(node, "alt"); altText != "" {
-			altText = altText
-		} else {
-			if src := getAttrVal(node, "src"); src != "" {
+		imageSrc := ctx.imageSource(node)
+		//on a single line, as it goes in the link line too
+		altText := strings.TrimSpace(spacingRe.ReplaceAllString(getAttrVal(node, "alt"), " "))
+		if altText == "" {
+			if src := imageSrc; src != "" && !hasScheme(src, "data") {
 				//try to ge the last element of the path
 				fileName := filepath.Base(src)
 				fileBase := strings.TrimSuffix(fileName, filepath.Ext(fileName))
 				altText = fileBase
 			}
 		}
-		altText = "[" + ctx.options.ImageMarkerPrefix + " " + altText + "]"
-		altText = strings.ReplaceAll(altText, "_", " ")
-		altText = strings.ReplaceAll(altText, "-", " ")
-		altText = strings.ReplaceAll(altText, "  ", " ")
+		altText = "[" + ctx.options.ImageMarkerPrefix + " " + altText + "]"
+		altText = strings.ReplaceAll(altText, "_", " ")
+		altText = strings.ReplaceAll(altText, "-", " ")
+		altText = strings.ReplaceAll(altText, "  ", " ")
+
+		if ctx.options.EmitImagesAsLinks {
+			if err := ctx.emit(altText); err != nil {
+				return err
+			}
+
+			if attrVal := imageSrc; attrVal != "" {
+				attrVal = ctx.normalizeHrefLink(attrVal)
+				if !ctx.options.OmitLinks && attrVal != "" && altText != attrVal {
+					return ctx.emitCitation(attrVal, altText, true)
+				}
+			}
+			return nil
+		} else {
+			return ctx.emit(altText)
+		}
+
+	case atom.Video, atom.Audio:
+		if !ctx.options.EmitMediaAsLinks {
+			return ctx.traverseChildren(node)
+		}
+		return ctx.mediaHandler(node)
+
+	case atom.Source:
+		//sources are rendered by their media element
+		return nil
+
+	case atom.Iframe:
+		if !ctx.options.EmitIframesAsLinks {
+			return ctx.traverseChildren(node)
+		}
+		return ctx.iframeHandler(node)
+
+	case atom.A:
+		linkText := ""
+		// For simple link element content with single text node only, peek at the link text.
+		if node.FirstChild != nil && node.FirstChild.NextSibling == nil && node.FirstChild.Type == html.TextNode {
+			linkText = node.FirstChild.Data
+		}
+
+		// A link around blocks, such as a card with a heading and a summary, is named by its
+		// heading or else all of its text, and cited once at the end of the last line.
+		isBlockLink := hasBlockContent(node)
+		if isBlockLink {
+			text, err := ctx.blockLinkText(node)
+			if err != nil {
+				return err
+			}
+			linkText = text
+		}
+
+		if err := ctx.traverseChildren(node); err != nil {
+			return err
+		}
+		breaks := 0
+		if isBlockLink {
+			breaks = ctx.reopenLastLine()
+		}
+
+		// If image is the only child, the image will have been shown with its alt text, which
+		// names the link too. Without any, choose a simple marker for the link itself. If images
+		// are left out there is nothing to link from, so the link goes too.
+		if img := node.FirstChild; img != nil && node.LastChild == img && img.DataAtom == atom.Img {
+			if ctx.options.OmitImages {
+				return nil
+			}
+			linkText = strings.TrimSpace(spacingRe.ReplaceAllString(getAttrVal(img, "alt"), " "))
+			if linkText == "" && ctx.options.EmptyLinkPrefix != "" {
+				linkText = ctx.options.EmptyLinkPrefix
+				if err := ctx.emit(" " + linkText); err != nil {
+					return err
+				}
+			}
+		}
+
+		download := ""
+		if ctx.options.AnnotateDownloads {
+			download = ctx.downloadMarker(node)
+			if err := ctx.emit(download); err != nil {
+				return err
+			}
+		}
+
+		if attrVal := getAttrVal(node, "href"); attrVal != "" && !ctx.skipFragmentLink(attrVal) {
+			attrVal = ctx.normalizeHrefLink(attrVal)
+			// Don't print link href if it matches link element content or if the link is empty.
+			if !ctx.options.OmitLinks && attrVal != "" && linkText != attrVal {
+				display := linkText
+				if title := strings.TrimSpace(spacingRe.ReplaceAllString(getAttrVal(node, "title"), " ")); ctx.options.PreferTitleAttribute && title != "" {
+					display = title
+				}
+				if download != "" {
+					display = strings.TrimSpace(display + " " + download)
+				}
+				if err := ctx.emitCitation(attrVal, display, false); err != nil {
+					return err
+				}
+			}
+		}
+		return ctx.emit(strings.Repeat("\n", breaks))
+
+	case atom.Ul:
+
+		return ctx.listHandler(node, listLevel{})
+
+	case atom.Ol:
+
+		//a reversed list counts down, by default from the number of items
+		reversed := hasAttr(node, "reversed")
+		start := 1
+		if reversed {
+			start = ctx.countListItems(node)
+		}
+		if attrVal := getAttrVal(node, "start"); attrVal != "" {
+			if n, err := strconv.Atoi(strings.TrimSpace(attrVal)); err == nil {
+				start = n
+			}
+		}
+		return ctx.listHandler(node, listLevel{ordered: true, index: start, numbering: getAttrVal(node, "type"), reversed: reversed})
+
+	case atom.P:
+		if ctx.isPlainText(node) {
+			//no links, so the text goes straight out
+			if err := ctx.traverseChildren(node); err != nil {
+				return err
+			}
+			return ctx.emit("\n")
+		}
+
+		//render the paragraph once, in a child context, to see if it just has a single link
+		//in which case we'll output a link line, or no links in which case we output just the text
+		child := ctx.newChildContext()
+		if err := child.startParagraph(); err != nil {
+			ctx.adoptChildContext(&child)
+			return err
+		}
+		start := child.buf.Len()
+		if err := child.traverseChildren(node); err != nil {
+			ctx.adoptChildContext(&child)
+			return err
+		}
+		text := child.textFrom(start)
+
+		//if content contains just one link, output a link instead of a para if within a specified number of
+		//words, and not alongside a run of link lines
+		maxSingletonLinkLength := ctx.options.ListItemToLinkWordThreshold
+		if (len(strings.Fields(text)) <= maxSingletonLinkLength) && !child.hasLinkRun {
+			if url, ok := ctx.takeSingleLink(&child); ok {
+				return ctx.emitLinkLine(url, text)
+			}
+		}
+
+		//if no links, just emit a para with the text, ignoring any sub elements
+		if len(child.citations) == 0 {
+			ctx.adoptTestContext(&child)
+			return ctx.emit(text + "\n")
+		}
+
+		//else - mixed content, rendered as it is
+		ctx.adoptChildContext(&child)
+		return ctx.endParagraph()
+
+	case atom.Table, atom.Tfoot, atom.Th, atom.Tr, atom.Td, atom.Caption:
+		if node.DataAtom == atom.Table {
+			ctx.counts.tables++
+		}
+
+		if ctx.options.PrettyTables {
+			return ctx.handleTableElement(node)
+		} else if node.DataAtom == atom.Table {
+			//just treat tables as a type of paragraph, marked as one unless in plain text
+			if ctx.options.OutputFormat != OutputFormatPlainText {
+				if err := ctx.emit("\n\n⊞ table ⊞\n\n"); err != nil {
+					return err
+				}
+			}
+			return ctx.paragraphHandler(node)
+		} else if node.DataAtom == atom.Caption {
+			//keep the caption apart from the cell text
+			return ctx.paragraphHandler(node)
+		}
+
+		if node.DataAtom == atom.Tr {
+			//start a new line
+			if err := ctx.emit("\n"); err != nil {
+				return err
+			}
+		}
+
+		return ctx.traverseChildren(node)
+
+	case atom.Pre:
+		//the fences need lines of their own, set apart unless compact
+		open, close := "\n\n"+ctx.fence(preLanguage(node))+"\n", "\n"+ctx.fence("")+"\n\n"
+		if ctx.options.CompactPre {
+			open, close = ctx.fence(preLanguage(node))+"\n", "\n"+ctx.fence("")+"\n"
+			if ctx.lineLength > 0 {
+				open = "\n" + open
+			}
+		}
+		if err := ctx.emit(open); err != nil {
+			return err
+		}
+		ctx.isPre = true
+		err := ctx.traverseChildren(node)
+		ctx.isPre = false
+		if err != nil {
+			return err
+		}
+		return ctx.emit(close)
+
+	case atom.Style, atom.Script, atom.Head:
+		// Ignore the subtree.
+		return nil
+
+	default:
+		return ctx.traverseChildren(node)
+	}
+}
+
+// mediaHandler renders a video or audio element as a link to its source, in
+// place of any fallback content.
+func (ctx *TextifyTraverseContext) mediaHandler(node *html.Node) error {
+	src := getAttrVal(node, "src")
+	for c := node.FirstChild; c != nil && src == ""; c = c.NextSibling {
+		if c.DataAtom == atom.Source {
+			src = getAttrVal(c, "src")
+		}
+	}
+
+	label := getAttrVal(node, "title")
+	if label == "" {
+		label = getAttrVal(node, "alt")
+	}
+	if poster := getAttrVal(node, "poster"); label == "" && poster != "" && !hasScheme(poster, "data") {
+		fileName := filepath.Base(poster)
+		label = strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	}
+	if label == "" {
+		label = node.Data
+	}
+	display := "[" + strings.TrimSpace(spacingRe.ReplaceAllString(label, " ")) + "]"
+
+	if err := ctx.emit(display); err != nil {
+		return err
+	}
+	if src = ctx.normalizeHrefLink(src); src != "" && !ctx.options.OmitLinks {
+		return ctx.emitCitation(src, display, true)
+	}
+	return nil
+}
+
+// hasBlockContent reports whether any element within node is a block, rather than text.
+func hasBlockContent(node *html.Node) bool {
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && (blockElements[c.DataAtom] || hasBlockContent(c)) {
+			return true
+		}
+	}
+	return false
+}
+
+// blockElements are the elements rendered as blocks of their own.
+var blockElements = map[atom.Atom]bool{
+	atom.Address: true, atom.Article: true, atom.Aside: true, atom.Blockquote: true, atom.Details: true,
+	atom.Dialog: true, atom.Div: true, atom.Dl: true, atom.Figure: true, atom.Footer: true, atom.H1: true, atom.H2: true,
+	atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true, atom.Header: true, atom.Hr: true,
+	atom.Li: true, atom.Main: true, atom.Nav: true, atom.Ol: true, atom.P: true, atom.Pre: true,
+	atom.Section: true, atom.Table: true, atom.Ul: true,
+}
+
+// blockLinkText returns the text naming a link around blocks: that of its first heading,
+// or else all of its text on a single line.
+func (ctx *TextifyTraverseContext) blockLinkText(a *html.Node) (string, error) {
+	testCtx := ctx.newTestContext()
+	if heading := firstHeading(a); heading != nil {
+		testCtx.inHeading = true
+		a = heading
+	}
+	if err := testCtx.traverseChildren(a); err != nil {
+		return "", err
+	}
+	text := strings.ReplaceAll(testCtx.buf.String(), blankLineMark, "")
+	return strings.TrimSpace(spacingRe.ReplaceAllString(text, " ")), nil
+}
+
+// firstHeading returns the first of the headings <h1> to <h6> within node, or nil.
+func firstHeading(node *html.Node) *html.Node {
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode {
+			continue
+		}
+		switch c.DataAtom {
+		case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+			return c
+		}
+		if heading := firstHeading(c); heading != nil {
+			return heading
+		}
+	}
+	return nil
+}
+
+// reopenLastLine takes back the line breaks at the end of the output, so that more can
+// be added to its last line of text, returning how many there were.
+func (ctx *TextifyTraverseContext) reopenLastLine() int {
+	breaks := 0
+	end := []byte("\n" + ctx.prefix)
+	for bytes.HasSuffix(ctx.buf.Bytes(), end) {
+		ctx.buf.Truncate(ctx.buf.Len() - len(end))
+		breaks++
+	}
+	if breaks == 0 {
+		return 0
+	}
+
+	text := ctx.buf.Bytes()
+	line := text[bytes.LastIndexByte(text, '\n')+1:]
+	if len(line) < len(text) {
+		line = bytes.TrimPrefix(line, []byte(ctx.prefix))
+	}
+	ctx.lineLength = utf8.RuneCount(line)
+	last, _ := utf8.DecodeLastRune(line)
+	ctx.endsWithSpace = len(line) == 0 || unicode.IsSpace(last) || punctNoSpaceAfter(last)
+	return breaks
+}
+
+// downloadMarker returns the marker of a link to a file, or "" if the link is to a page.
+// A link is to a file if it has a download attribute, or its path has the extension of
+// a kind of file that is downloaded rather than viewed.
+func (ctx *TextifyTraverseContext) downloadMarker(a *html.Node) string {
+	ext := ""
+	if u, err := url.Parse(strings.TrimSpace(getAttrVal(a, "href"))); err == nil {
+		ext = strings.ToLower(strings.TrimPrefix(filepath.Ext(u.Path), "."))
+	}
+	if !downloadExtensions[ext] {
+		if !hasAttr(a, "download") {
+			return ""
+		}
+		if ext == "" {
+			ext = "file"
+		}
+	}
+
+	marker := ctx.options.DownloadMarker
+	if marker == "" {
+		marker = defaultDownloadMarker
+	}
+	return strings.Replace(marker, "%s", ext, -1)
+}
+
+// downloadExtensions are the extensions of files that are downloaded rather than viewed.
+var downloadExtensions = map[string]bool{
+	"pdf": true, "epub": true, "mobi": true, "doc": true, "docx": true, "odt": true, "rtf": true,
+	"xls": true, "xlsx": true, "ods": true, "csv": true, "ppt": true, "pptx": true, "odp": true,
+	"zip": true, "gz": true, "tgz": true, "bz2": true, "xz": true, "tar": true, "7z": true, "rar": true,
+	"exe": true, "msi": true, "dmg": true, "pkg": true, "deb": true, "rpm": true, "apk": true, "iso": true,
+	"mp3": true, "ogg": true, "flac": true, "wav": true, "mp4": true, "mkv": true, "webm": true,
+}
+
+// iframeHandler renders embedded content as a link to its source, labelled with its
+// title or name. Frames without a source, or with a blank one, are left out.
+func (ctx *TextifyTraverseContext) iframeHandler(node *html.Node) error {
+	src := strings.TrimSpace(getAttrVal(node, "src"))
+	if src == "" || strings.EqualFold(src, "about:blank") {
+		return nil
+	}
+
+	label := getAttrVal(node, "title")
+	if strings.TrimSpace(label) == "" {
+		label = getAttrVal(node, "name")
+	}
+	if strings.TrimSpace(label) == "" {
+		label = defaultIframeLabel
+	}
+	display := "[" + strings.TrimSpace(spacingRe.ReplaceAllString(label, " ")) + "]"
+
+	if err := ctx.emit(display); err != nil {
+		return err
+	}
+	if src = ctx.normalizeHrefLink(src); src != "" && !ctx.options.OmitLinks {
+		return ctx.emitCitation(src, display, false)
+	}
+	return nil
+}
+
+// preLanguage returns the language of a preformatted block, from a class like
+// language-go or lang-go on the <pre> or on a <code> element directly within it.
+func preLanguage(pre *html.Node) string {
+	if lang := classLanguage(pre); lang != "" {
+		return lang
+	}
+	for c := pre.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.TextNode && strings.TrimSpace(c.Data) == "" {
+			continue
+		}
+		if c.DataAtom == atom.Code {
+			return classLanguage(c)
+		}
+		break
+	}
+	return ""
+}
+
+// classLanguage returns the language named by a language-xxx or lang-xxx class of node.
+func classLanguage(node *html.Node) string {
+	for _, class := range strings.Fields(getAttrVal(node, "class")) {
+		for _, prefix := range []string{"language-", "lang-"} {
+			if strings.HasPrefix(class, prefix) && len(class) > len(prefix) {
+				return class[len(prefix):]
+			}
+		}
+	}
+	return ""
+}
+
+// blockquoteHandler renders a block quote, each line starting with the quote marker,
+// followed by its attribution if it has one.
+func (ctx *TextifyTraverseContext) blockquoteHandler(node *html.Node, attribution *html.Node) error {
+	if err := ctx.FlushCitations(); err != nil {
+		return err
+	}
+
+	//the quote starts on a line of its own, and as a new paragraph at the top level
+	if ctx.blockquoteLevel == 0 {
+		if err := ctx.emit("\n\n"); err != nil {
+			return err
+		}
+	} else if ctx.lineLength > 0 {
+		if err := ctx.emit("\n"); err != nil {
+			return err
+		}
+	}
+	outerPrefix := ctx.prefix
+	ctx.blockquoteLevel++
+	ctx.prefix = ctx.blockquotePrefix(ctx.blockquoteLevel)
+	if err := ctx.replaceLinePrefix(outerPrefix); err != nil {
+		return err
+	}
+
+	if err := ctx.traverseChildren(node); err != nil {
+		return err
+	}
+	if attribution != nil {
+		if err := ctx.attributionHandler(attribution); err != nil {
+			return err
+		}
+	}
+
+	innerPrefix := ctx.prefix
+	ctx.blockquoteLevel--
+	ctx.prefix = ctx.blockquotePrefix(ctx.blockquoteLevel)
+
+	//don't leave a line with just the quote marker at the end of the quote
+	if ctx.lineLength == 0 {
+		if err := ctx.replaceLinePrefix(innerPrefix); err != nil {
+			return err
+		}
+	} else if err := ctx.emit("\n"); err != nil {
+		return err
+	}
+	if ctx.blockquoteLevel == 0 {
+		return ctx.emit("\n")
+	}
+	return nil
+}
+
+// attributionHandler renders the attribution of a quote on a line of its own, starting
+// with a dash unless it already has one.
+func (ctx *TextifyTraverseContext) attributionHandler(node *html.Node) error {
+	if ctx.lineLength > 0 {
+		if err := ctx.emit("\n"); err != nil {
+			return err
+		}
+	}
+	testCtx := ctx.newTestContext()
+	if err := testCtx.traverseChildren(node); err != nil {
+		return err
+	}
+	if first, _ := utf8.DecodeRuneInString(strings.TrimSpace(testCtx.buf.String())); !strings.ContainsRune("-‐‒–—―", first) {
+		if err := ctx.emit(ctx.options.QuoteAttributionPrefix); err != nil {
+			return err
+		}
+	}
+	return ctx.traverseChildren(node)
+}
+
+// quoteFigure returns the block quote and caption of a figure that consists of just
+// those, or nil if the figure is anything else.
+func quoteFigure(figure *html.Node) (quote *html.Node, caption *html.Node) {
+	for c := figure.FirstChild; c != nil; c = c.NextSibling {
+		switch {
+		case c.Type == html.TextNode && strings.TrimSpace(c.Data) == "", c.Type == html.CommentNode:
+			continue
+		case c.Type == html.ElementNode && c.DataAtom == atom.Blockquote && quote == nil:
+			quote = c
+		case c.Type == html.ElementNode && c.DataAtom == atom.Figcaption && caption == nil:
+			caption = c
+		default:
+			return nil, nil
+		}
+	}
+	if caption == nil {
+		return nil, nil
+	}
+	return quote, caption
+}
+
+// paragraphHandler renders node children surrounded by double newlines.
+func (ctx *TextifyTraverseContext) paragraphHandler(node *html.Node) error {
+	if err := ctx.startParagraph(); err != nil {
+		return err
+	}
+	if err := ctx.traverseChildren(node); err != nil {
+		return err
+	}
+	return ctx.endParagraph()
+}
+
+// startParagraph starts a paragraph, after any citations due before it.
+func (ctx *TextifyTraverseContext) startParagraph() error {
+	if err := ctx.CheckFlushCitations(); err != nil {
+		return err
+	}
+	return ctx.emit("\n\n")
+}
+
+// endParagraph ends a paragraph, followed by its citations when they go straight after it.
+func (ctx *TextifyTraverseContext) endParagraph() error {
+	if err := ctx.emit("\n\n"); err != nil {
+		return err
+	}
+
+	if ctx.linkStyle() == LinkStyleFootnoteImmediate {
+		return ctx.FlushCitations()
+	}
+	return nil
+}
+
+// newTestContext returns a scratch context sharing the rendering options, used to
+// examine a subtree before deciding how to output it. Citation markers are left out
+// so the text can be reused as link text.
+func (ctx *TextifyTraverseContext) newTestContext() TextifyTraverseContext {
+	options := ctx.options
+	options.CitationStyle = CitationStyleNone
+	abbreviations := make(map[string]bool, len(ctx.abbreviations))
+	for title := range ctx.abbreviations {
+		abbreviations[title] = true
+	}
+	return TextifyTraverseContext{
+		options:         options,
+		listStack:       append([]listLevel(nil), ctx.listStack...),
+		definitionLevel: ctx.definitionLevel,
+		baseURL:         ctx.baseURL,
+		abbreviations:   abbreviations,
+		quoteLevel:      ctx.quoteLevel,
+		inHeading:       ctx.inHeading,
+		cancel:          ctx.cancel,
+		depth:           ctx.depth,
+		inAppendix:      ctx.inAppendix,
+	}
+}
+
+// isPlainText reports whether the content of node is just text, perhaps formatted,
+// and so needs no test context to see how it is to be rendered, as it has no links
+// or blocks. Custom element handlers might emit anything, and a test context starts
+// outside any preformatted, code or other inline text, so those always need one.
+func (ctx *TextifyTraverseContext) isPlainText(node *html.Node) bool {
+	if len(ctx.options.ElementHandlers) > 0 || ctx.isPre || ctx.isCode || ctx.inlineLevel > 0 {
+		return false
+	}
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		switch c.Type {
+		case html.TextNode, html.CommentNode:
+			continue
+		case html.ElementNode:
+			if !plainTextElements[c.DataAtom] || !ctx.isPlainText(c) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// priceReplacement returns the <ins> straight after the struck out element del when
+// both hold a price, as for a sale price replacing the original one, or else nil.
+func priceReplacement(del *html.Node) *html.Node {
+	ins := del.NextSibling
+	for ins != nil && ins.Type == html.TextNode && strings.TrimSpace(ins.Data) == "" {
+		ins = ins.NextSibling
+	}
+	if ins == nil || ins.Type != html.ElementNode || ins.DataAtom != atom.Ins || !hasDigit(del) || !hasDigit(ins) {
+		return nil
+	}
+	return ins
+}
+
+// replacedPrice returns the struck out element straight before ins whose price it
+// replaces, or else nil.
+func replacedPrice(ins *html.Node) *html.Node {
+	del := ins.PrevSibling
+	for del != nil && del.Type == html.TextNode && strings.TrimSpace(del.Data) == "" {
+		del = del.PrevSibling
+	}
+	if del == nil || del.Type != html.ElementNode || priceReplacement(del) != ins {
+		return nil
+	}
+	switch del.DataAtom {
+	case atom.Del, atom.S, atom.Strike:
+		return del
+	}
+	return nil
+}
+
+// hasDigit reports whether the text within node has a digit.
+func hasDigit(node *html.Node) bool {
+	if node.Type == html.TextNode {
+		return strings.IndexFunc(node.Data, unicode.IsDigit) >= 0
+	}
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if hasDigit(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// rubyContinues reports whether there is more base text after the reading rt, within
+// its ruby annotation.
+func rubyContinues(rt *html.Node) bool {
+	for next := rt.NextSibling; next != nil; next = next.NextSibling {
+		switch {
+		case next.Type == html.TextNode && strings.TrimSpace(next.Data) == "":
+		case next.Type == html.ElementNode && next.DataAtom == atom.Rp:
+		case next.Type == html.CommentNode:
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// spacedText reports whether node is text starting, or else ending, with a space.
+func spacedText(node *html.Node, start bool) bool {
+	if node == nil || node.Type != html.TextNode || node.Data == "" {
+		return false
+	}
+	var r rune
+	if start {
+		r, _ = utf8.DecodeRuneInString(node.Data)
+	} else {
+		r, _ = utf8.DecodeLastRuneInString(node.Data)
+	}
+	return unicode.IsSpace(r)
+}
+
+// plainTextElements are the inline elements that render as text, without links. Inline
+// code is not among them, as the spacing within it is kept.
+var plainTextElements = map[atom.Atom]bool{
+	atom.B: true, atom.Strong: true, atom.Em: true, atom.I: true, atom.U: true, atom.Mark: true,
+	atom.Del: true, atom.Ins: true, atom.S: true, atom.Strike: true, atom.Span: true, atom.Small: true,
+	atom.Abbr: true, atom.Sup: true, atom.Sub: true, atom.Time: true, atom.Dfn: true, atom.Wbr: true,
+	atom.Ruby: true, atom.Rb: true, atom.Rt: true, atom.Rp: true,
+}
+
+// adoptTestContext keeps the state gathered while rendering testCtx, when its
+// output is used rather than rendering the same nodes again.
+func (ctx *TextifyTraverseContext) adoptTestContext(testCtx *TextifyTraverseContext) {
+	for _, link := range testCtx.links {
+		if link.Index == 0 {
+			//emitted directly, as a link line or inline, rather than cited
+			ctx.links = append(ctx.links, link)
+		}
+	}
+	ctx.abbreviations = testCtx.abbreviations
+	ctx.headings = append(ctx.headings, testCtx.headings...)
+	ctx.appendix = append(ctx.appendix, testCtx.appendix...)
+	ctx.hasLinkRun = ctx.hasLinkRun || testCtx.hasLinkRun
+	ctx.counts.add(testCtx.counts)
+}
+
+// newChildContext returns a context carrying on from ctx, which renders nodes just as
+// ctx would but to a buffer of its own. Its text may then be added to that of ctx with
+// adoptChildContext, or be taken without the citations to be emitted some other way.
+func (ctx *TextifyTraverseContext) newChildContext() TextifyTraverseContext {
+	child := *ctx
+	child.buf = bytes.Buffer{}
+	child.written = ctx.written + ctx.buf.Len()
+	child.out = nil
+	child.listStack = append([]listLevel(nil), ctx.listStack...)
+	child.links = nil
+	child.headings = nil
+	child.appendix = nil
+	child.counts = elementCounts{}
+	child.hasLinkRun = false
+	child.citations = nil
+	child.quoteBreaks = nil
+	return child
+}
+
+// adoptChildContext adds the text rendered by child to that of ctx, carrying on from
+// where child left off.
+func (ctx *TextifyTraverseContext) adoptChildContext(child *TextifyTraverseContext) {
+	if bytes.HasPrefix(child.buf.Bytes(), []byte("\n")) && ctx.lineLength > 0 && !ctx.isPre {
+		ctx.trimIndentLine()
+	}
+	for _, mark := range child.citations {
+		mark.start += ctx.buf.Len()
+		mark.end += ctx.buf.Len()
+		ctx.citations = append(ctx.citations, mark)
+	}
+	for _, at := range child.quoteBreaks {
+		ctx.quoteBreaks = append(ctx.quoteBreaks, at+ctx.buf.Len())
+	}
+	ctx.buf.Write(child.buf.Bytes())
+	ctx.links = append(ctx.links, child.links...)
+	ctx.abbreviations = child.abbreviations
+	ctx.headings = append(ctx.headings, child.headings...)
+	ctx.appendix = append(ctx.appendix, child.appendix...)
+	ctx.hasLinkRun = ctx.hasLinkRun || child.hasLinkRun
+	ctx.counts.add(child.counts)
+	ctx.linkAccumulator = child.linkAccumulator
+	ctx.tableCtx = child.tableCtx
+	ctx.endsWithSpace = child.endsWithSpace
+	ctx.justClosedDiv = child.justClosedDiv
+	ctx.lineLength = child.lineLength
+	ctx.breakRun = child.breakRun
+	ctx.visited = child.visited
+}
+
+// textFrom returns the text rendered from start on, without its citation markers or
+// the prefix of each line, and with the lines of quoted text broken to fit joined up
+// again, as the text of a test context would be.
+func (ctx *TextifyTraverseContext) textFrom(start int) string {
+	rendered := ctx.buf.Bytes()
+	var text strings.Builder
+	breaks := ctx.quoteBreaks
+	write := func(end int) {
+		for ; len(breaks) > 0 && breaks[0] < end; breaks = breaks[1:] {
+			if at := breaks[0]; at >= start {
+				text.Write(rendered[start:at])
+				text.WriteByte(' ')
+				start = at + len("\n"+ctx.prefix)
+			}
+		}
+		text.Write(rendered[start:end])
+	}
+	for _, mark := range ctx.citations {
+		//a mark with no marker may be left beyond the end of text since taken back
+		if mark.start >= start && mark.end <= len(rendered) {
+			write(mark.start)
+			start = mark.end
+		}
+	}
+	write(len(rendered))
+	if ctx.prefix == "" {
+		return text.String()
+	}
+	return strings.ReplaceAll(text.String(), "\n"+ctx.prefix, "\n")
+}
+
+// takeSingleLink returns the url of the only link child cited, when there is just one,
+// taking back its citation so that the text of child can go in a link line instead.
+func (ctx *TextifyTraverseContext) takeSingleLink(child *TextifyTraverseContext) (string, bool) {
+	if len(child.citations) != 1 || child.linkAccumulator.sectionStart != ctx.linkAccumulator.sectionStart {
+		return "", false
+	}
+	url := child.citations[0].url
+	if len(child.linkAccumulator.linkArray) > len(ctx.linkAccumulator.linkArray) {
+		//cited for the first time, so not to be cited again as a duplicate either
+		delete(ctx.linkAccumulator.urlIndex, url)
+	}
+	ctx.adoptTestContext(child)
+	return url, true
+}
+
+// inlineHandler renders node children wrapped in the given markers, which stick to
+// the enclosed text. Nothing is emitted if the children render no text.
+func (ctx *TextifyTraverseContext) inlineHandler(node *html.Node, open string, close string) error {
+	start, endsWithSpace, lineLength := ctx.buf.Len(), ctx.endsWithSpace, ctx.lineLength
+	ctx.inlineLevel++
+	defer func() {
+		ctx.inlineLevel--
+	}()
+
+	if err := ctx.emit(open); err != nil {
+		return err
+	}
+	if open != "" {
+		ctx.endsWithSpace = true
+	}
+
+	contentStart := ctx.buf.Len()
+	if err := ctx.traverseChildren(node); err != nil {
+		return err
+	}
+	if ctx.buf.Len() == contentStart {
+		//empty element, so drop the opening marker again
+		ctx.buf.Truncate(start)
+		ctx.dropQuoteBreaks(start)
+		ctx.endsWithSpace, ctx.lineLength = endsWithSpace, lineLength
+		return nil
+	}
+
+	return ctx.emitAttached(close)
+}
+
+// blockquotePrefix returns the prefix for lines of a blockquote nested to the given level.
+func (ctx *TextifyTraverseContext) blockquotePrefix(level int) string {
+	if level == 0 || ctx.options.OutputFormat == OutputFormatPlainText {
+		return ""
+	}
+	marker := ctx.options.BlockquotePrefix
+	if marker == "" {
+		marker = ">"
+	}
+	prefix := strings.Repeat(marker, level)
+	if !strings.HasSuffix(prefix, " ") {
+		prefix += " "
+	}
+	return prefix
+}
+
+// replaceLinePrefix replaces the prefix old at the start of the current, empty,
+// line with the current prefix.
+func (ctx *TextifyTraverseContext) replaceLinePrefix(old string) error {
+	if old != "" && bytes.HasSuffix(ctx.buf.Bytes(), []byte(old)) {
+		ctx.buf.Truncate(ctx.buf.Len() - len(old))
+	}
+	_, err := ctx.buf.WriteString(ctx.prefix)
+	return err
+}
+
+// recordHeading adds a heading to the table of contents, if one is wanted.
+func (ctx *TextifyTraverseContext) recordHeading(node *html.Node) error {
+	if !ctx.options.GenerateTOC {
+		return nil
+	}
+	testCtx := ctx.newTestContext()
+	testCtx.inHeading = true
+	if err := testCtx.traverseChildren(node); err != nil {
+		return err
+	}
+	if text := strings.TrimSpace(spacingRe.ReplaceAllString(testCtx.buf.String(), " ")); text != "" {
+		ctx.headings = append(ctx.headings, tocEntry{level: headingLevel(node), text: text})
+	}
+	return nil
+}
+
+// formattingMarker returns the marker for inline formatting, or nothing if formatting
+// is disabled, or within a heading unless formatting is wanted there.
+func (ctx *TextifyTraverseContext) formattingMarker(marker string) string {
+	if ctx.options.DisableInlineFormatting || ctx.inHeading && !ctx.options.FormattingInHeadings {
+		return ""
+	}
+	return marker
+}
+
+// headingLevel returns the level of a heading element, from 1 for <h1> to 6 for <h6>.
+func headingLevel(node *html.Node) int {
+	return int(node.Data[1] - '0')
+}
+
+// startSection starts a new section at a heading of the given level when citations
+// are numbered per section, emitting the links of the previous one. With all the links
+// listed at the end instead, the numbering runs on.
+func (ctx *TextifyTraverseContext) startSection(level int) error {
+	sectionLevel := ctx.options.CitationSectionLevel
+	if sectionLevel < 1 {
+		sectionLevel = 1
+	}
+	if !ctx.options.CitationsPerSection || ctx.options.CitationsAtEndOnly || level > sectionLevel || ctx.linkAccumulator.tableNestLevel > 0 {
+		return nil
+	}
+	if err := ctx.emitGeminiCitations(); err != nil {
+		return err
+	}
+	ctx.linkAccumulator.sectionStart = len(ctx.linkAccumulator.linkArray)
+	ctx.linkAccumulator.urlIndex = nil
+	return nil
+}
+
+// nextCitationIndex returns the number of the next citation.
+func (ctx *TextifyTraverseContext) nextCitationIndex() int {
+	return len(ctx.linkAccumulator.linkArray) - ctx.linkAccumulator.sectionStart + ctx.options.CitationStart
+}
+
+// emitTOC emits the table of contents as a list of the headings, indented by level.
+func (ctx *TextifyTraverseContext) emitTOC(headings []tocEntry) error {
+	if len(headings) == 0 {
+		return nil
+	}
+	top := headings[0].level
+	for _, heading := range headings {
+		if heading.level < top {
+			top = heading.level
+		}
+	}
+
+	if err := ctx.emit("\n\n"); err != nil {
+		return err
+	}
+	for _, heading := range headings {
+		indent := strings.Repeat(ctx.options.ListIndent, heading.level-top)
+		if err := ctx.emit(indent + ctx.bulletMarker() + heading.text + "\n"); err != nil {
+			return err
+		}
+	}
+	return ctx.emit("\n")
+}
+
+// emitAppendix renders the navigation and then the footers kept for the end, each
+// under its heading, followed by their links.
+func (ctx *TextifyTraverseContext) emitAppendix() error {
+	if len(ctx.appendix) == 0 {
+		return nil
+	}
+	ctx.inAppendix = true
+	defer func() {
+		ctx.inAppendix = false
+	}()
+
+	sections := []struct {
+		element atom.Atom
+		heading string
+	}{
+		{atom.Nav, ctx.options.NavigationHeading},
+		{atom.Footer, ctx.options.FooterHeading},
+	}
+	for _, section := range sections {
+		headed := section.heading == ""
+		for _, node := range ctx.appendix {
+			if node.DataAtom != section.element {
+				continue
+			}
+			if !headed {
+				if err := ctx.emit("\n\n" + ctx.headingPrefix(2) + section.heading + "\n\n"); err != nil {
+					return err
+				}
+				headed = true
+			}
+			if err := ctx.paragraphHandler(node); err != nil {
+				return err
+			}
+		}
+	}
+	return ctx.FlushCitations()
+}
+
+// taskMarker returns the marker for a list item that starts with a checkbox, as in a
+// task list, or the empty string for any other item.
+func (ctx *TextifyTraverseContext) taskMarker(li *html.Node) string {
+	checkbox := leadingCheckbox(li)
+	if checkbox == nil {
+		return ""
+	}
+	if hasAttr(checkbox, "checked") {
+		return ctx.options.CheckedTaskMarker
+	}
+	return ctx.options.UncheckedTaskMarker
+}
+
+// leadingCheckbox returns the checkbox <input> that node starts with, looking inside
+// a leading paragraph or label, or nil if it does not start with one.
+func leadingCheckbox(node *html.Node) *html.Node {
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		switch {
+		case c.Type == html.TextNode && strings.TrimSpace(c.Data) == "":
+			continue
+		case c.Type != html.ElementNode:
+			return nil
+		case c.DataAtom == atom.Input:
+			if strings.EqualFold(getAttrVal(c, "type"), "checkbox") {
+				return c
+			}
+			return nil
+		case c.DataAtom == atom.P || c.DataAtom == atom.Label:
+			return leadingCheckbox(c)
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// fence returns a fence line of preformatted text, with info after the opening one.
+// In plain text it is marked to be left out of the output, unlike any text that
+// happens to start like one.
+func (ctx *TextifyTraverseContext) fence(info string) string {
+	if ctx.options.OutputFormat == OutputFormatPlainText {
+		return "```" + info + fenceMark
+	}
+	return "```" + info
+}
+
+// headingPrefix returns the prefix for a heading of the given level.
+func (ctx *TextifyTraverseContext) headingPrefix(level int) string {
+	if ctx.options.OutputFormat == OutputFormatPlainText {
+		return ""
+	}
+	if level <= len(ctx.options.HeadingPrefixes) {
+		return ctx.options.HeadingPrefixes[level-1]
+	}
+	return defaultHeadingPrefixes[level-1]
+}
+
+// quoteMarks returns the opening and closing marks for an inline quote at the
+// current level of nesting, alternating between the pairs of marks.
+func (ctx *TextifyTraverseContext) quoteMarks() (string, string) {
+	marks := ctx.options.QuoteMarks
+	if len(marks) < 2 {
+		marks = defaultQuoteMarks
+	}
+	pair := ctx.quoteLevel % (len(marks) / 2)
+	return marks[2*pair], marks[2*pair+1]
+}
 
-		if ctx.options.EmitImagesAsLinks {
-			if err := ctx.emit(altText); err != nil {
-				return err
-			}
+// scriptHandler renders superscript or subscript text using the unicode forms in
+// scripts, or with the fallback marker when some of the text has no such form. The
+// text is attached to any adjoining text.
+func (ctx *TextifyTraverseContext) scriptHandler(node *html.Node, scripts map[rune]rune, fallback string) error {
+	testCtx := ctx.newTestContext()
+	if err := testCtx.traverseChildren(node); err != nil {
+		return err
+	}
+	if len(testCtx.linkAccumulator.linkArray) > 0 {
+		//e.g. a footnote reference, so keep the link
+		return ctx.traverseChildren(node)
+	}
+	ctx.adoptTestContext(&testCtx)
 
-			if attrVal := getAttrVal(node, "src"); attrVal != "" {
-				attrVal = ctx.normalizeHrefLink(attrVal)
-				if !ctx.options.OmitLinks && attrVal != "" && altText != attrVal {
-					hrefLink = ctx.addGeminiCitation(attrVal, altText)
-				}
-			}
-			return ctx.emit(hrefLink)
-		} else {
-			return ctx.emit(altText)
+	text := strings.TrimSpace(testCtx.buf.String())
+	if text == "" {
+		return nil
+	}
+	if converted, ok := toScript(text, scripts); ok {
+		text = converted
+	} else if fallback != "" {
+		if utf8.RuneCountInString(text) > 1 {
+			text = "(" + text + ")"
 		}
+		text = fallback + text
+	}
 
-	case atom.A:
-		linkText := ""
-		// For simple link element content with single text node only, peek at the link text.
-		if node.FirstChild != nil && node.FirstChild.NextSibling == nil && node.FirstChild.Type == html.TextNode {
-			linkText = node.FirstChild.Data
+	var err error
+	if followsText(node) {
+		err = ctx.emitAttached(text)
+	} else {
+		err = ctx.emit(text)
+	}
+	if precedesText(node) {
+		ctx.endsWithSpace = true
+	}
+	return err
+}
+
+// toScript converts text to the unicode forms in scripts, if they all exist.
+func toScript(text string, scripts map[rune]rune) (string, bool) {
+	converted := make([]rune, 0, len(text))
+	for _, r := range text {
+		script, ok := scripts[r]
+		if !ok {
+			return text, false
 		}
+		converted = append(converted, script)
+	}
+	return string(converted), true
+}
 
-		if err := ctx.traverseChildren(node); err != nil {
+// followsText reports whether node directly follows text, without whitespace in between.
+func followsText(node *html.Node) bool {
+	prev := node.PrevSibling
+	if prev == nil || prev.Type != html.TextNode || prev.Data == "" {
+		return false
+	}
+	r, _ := utf8.DecodeLastRuneInString(prev.Data)
+	return !unicode.IsSpace(r)
+}
+
+// precedesText reports whether node is directly followed by text, without whitespace in between.
+func precedesText(node *html.Node) bool {
+	next := node.NextSibling
+	if next == nil || next.Type != html.TextNode || next.Data == "" {
+		return false
+	}
+	r, _ := utf8.DecodeRuneInString(next.Data)
+	return !unicode.IsSpace(r) && !punctNoSpaceBefore(r)
+}
+
+// listHandler renders a list as a paragraph, tracking its state so that nested
+// list items pick up the right marker.
+func (ctx *TextifyTraverseContext) listHandler(node *html.Node, level listLevel) error {
+	nested := len(ctx.listStack) > 0
+	ctx.listStack = append(ctx.listStack, level)
+	defer func() {
+		ctx.listStack = ctx.listStack[:len(ctx.listStack)-1]
+	}()
+
+	if !nested {
+		return ctx.paragraphHandler(node)
+	}
+
+	//nested lists start on the line after their parent item, without a blank line
+	if ctx.lineLength > 0 {
+		if err := ctx.emit("\n"); err != nil {
 			return err
 		}
+	}
+	return ctx.traverseChildren(node)
+}
 
-		// If image is the only child, the image will have been shown as a link with its alt text etc
-		// so choose a simple marker for the link itself
-		if img := node.FirstChild; img != nil && node.LastChild == img && img.DataAtom == atom.Img {
-			linkText = ctx.options.EmptyLinkPrefix
-			ctx.emit(" " + linkText)
+// listIndent returns the indent for items of the innermost list being rendered.
+func (ctx *TextifyTraverseContext) listIndent() string {
+	if len(ctx.listStack) < 2 {
+		return ""
+	}
+	return strings.Repeat(ctx.options.ListIndent, len(ctx.listStack)-1)
+}
+
+// inOrderedList reports whether the innermost list being rendered is an ordered list.
+func (ctx *TextifyTraverseContext) inOrderedList() bool {
+	return len(ctx.listStack) > 0 && ctx.listStack[len(ctx.listStack)-1].ordered
+}
+
+// listItemMarker returns the marker for the next item of the innermost list,
+// advancing the counter when it is an ordered list.
+func (ctx *TextifyTraverseContext) listItemMarker() string {
+	if !ctx.inOrderedList() {
+		return ctx.bulletMarker()
+	}
+	level := &ctx.listStack[len(ctx.listStack)-1]
+	marker := formatListIndex(level.index, level.numbering) + ". "
+	if level.reversed {
+		level.index--
+	} else {
+		level.index++
+	}
+	return marker
+}
+
+// bulletMarker returns the marker for the items of unordered lists.
+func (ctx *TextifyTraverseContext) bulletMarker() string {
+	if ctx.options.OutputFormat == OutputFormatPlainText {
+		return plainTextBulletMarker
+	}
+	return ctx.options.BulletMarker
+}
+
+// linkStyle returns the style links are rendered in, which in plain text is always
+// inline as there are no link lines.
+func (ctx *TextifyTraverseContext) linkStyle() LinkStyle {
+	if ctx.options.OutputFormat == OutputFormatPlainText {
+		return LinkStyleInline
+	}
+	return ctx.options.LinkStyle
+}
+
+// countListItems returns the number of items of list that are rendered.
+func (ctx *TextifyTraverseContext) countListItems(list *html.Node) int {
+	count := 0
+	for c := list.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode && c.DataAtom == atom.Li && !ctx.isHidden(c) && !ctx.isSkipped(c) {
+			count++
+		}
+	}
+	return count
+}
+
+// formatListIndex formats the index of an ordered list item as letters or roman
+// numerals for the list types "a", "A", "i" and "I", falling back to a number.
+func formatListIndex(index int, numbering string) string {
+	switch numbering {
+	case "a", "A":
+		if index < 1 {
+			break
+		}
+		letters := ""
+		for n := index; n > 0; n = (n - 1) / 26 {
+			letters = string(rune('a'+(n-1)%26)) + letters
+		}
+		if numbering == "A" {
+			letters = strings.ToUpper(letters)
 		}
+		return letters
 
-		hrefLink := ""
-		if attrVal := getAttrVal(node, "href"); attrVal != "" {
-			attrVal = ctx.normalizeHrefLink(attrVal)
-			// Don't print link href if it matches link element content or if the link is empty.
-			if !ctx.options.OmitLinks && attrVal != "" && linkText != attrVal {
-				hrefLink = ctx.addGeminiCitation(attrVal, linkText)
+	case "i", "I":
+		if index < 1 || index >= 4000 {
+			break
+		}
+		numeral := ""
+		n := index
+		for _, roman := range romanNumerals {
+			for n >= roman.value {
+				numeral += roman.symbol
+				n -= roman.value
 			}
 		}
+		if numbering == "i" {
+			numeral = strings.ToLower(numeral)
+		}
+		return numeral
+	}
+	return strconv.Itoa(index)
+}
 
-		return ctx.emit(hrefLink)
+var romanNumerals = []struct {
+	value  int
+	symbol string
+}{
+	{1000, "M"}, {900, "CM"}, {500, "D"}, {400, "CD"}, {100, "C"}, {90, "XC"},
+	{50, "L"}, {40, "XL"}, {10, "X"}, {9, "IX"}, {5, "V"}, {4, "IV"}, {1, "I"},
+}
 
-	case atom.Ul:
+// handleTableElement is only to be invoked when options.PrettyTables is active.
+func (ctx *TextifyTraverseContext) handleTableElement(node *html.Node) error {
+	if !ctx.options.PrettyTables {
+		panic("handleTableElement invoked when PrettyTables not active")
+	}
 
-		return ctx.paragraphHandler(node)
+	switch node.DataAtom {
+	case atom.Table:
 
-	case atom.P:
+		// Re-intialize all table context.
+		ctx.tableCtx.init()
 
-		//a test context to examine the list element to see if it just has a single link
-		//in which case we'll output a link line, or no links in which case we output just a bullet
-		testCtx := TextifyTraverseContext{}
-		if err := testCtx.traverseChildren(node); err != nil {
+		caption, err := ctx.tableCaption(node)
+		if err != nil {
 			return err
 		}
+		ctx.tableCtx.caption = caption
+		open, close := ctx.tableFences(caption)
 
-		//if content contains just one link, output a link instead of a para if within a specified number of
-		//words
-		maxSingletonLinkLength := ctx.options.ListItemToLinkWordThreshold
-		if (len(strings.Split(testCtx.buf.String(), " ")) < maxSingletonLinkLength) && (len(testCtx.linkAccumulator.linkArray) == 1) {
-			return ctx.emit("=> " + testCtx.linkAccumulator.linkArray[0].url + " " + testCtx.buf.String() + "\n")
+		if err := ctx.emit(open); err != nil {
+			return err
 		}
 
-		//if no links, just emit a para with the text, ignoring any sub elements
-		if len(testCtx.linkAccumulator.linkArray) == 0 {
-			return ctx.emit(testCtx.buf.String() + "\n")
+		ctx.linkAccumulator.tableNestLevel++
+
+		// Browse children, enriching context with table data.
+		if err := ctx.traverseChildren(node); err != nil {
+			return err
 		}
 
-		//else - mixed content
-		return ctx.paragraphHandler(node)
+		ctx.tableCtx.padRows()
+		var rendered string
+		switch ctx.options.TableStyle {
+		case TableStyleMarkdown:
+			rendered = ctx.tableCtx.markdown()
+		default:
+			rendered = ctx.asciiTable()
+		}
+		if err := ctx.emit(rendered); err != nil {
+			return err
+		}
 
-	case atom.Table, atom.Tfoot, atom.Th, atom.Tr, atom.Td:
+		ctx.linkAccumulator.tableNestLevel--
 
-		if ctx.options.PrettyTables {
-			return ctx.handleTableElement(node)
-		} else if node.DataAtom == atom.Table {
-			//just treat tables as a type of paragraph
-			ctx.emit("\n\n⊞ table ⊞\n\n")
-			return ctx.paragraphHandler(node)
+		if err := ctx.emit(close); err != nil {
+			return err
+		}
+		if ctx.linkAccumulator.tableNestLevel == 0 {
+			//list the links from the cells straight after the table
+			if err := ctx.FlushCitations(); err != nil {
+				return err
+			}
 		}
+		return nil
 
-		if node.DataAtom == atom.Tr {
-			//start a new line
-			ctx.emit("\n")
+	case atom.Caption:
+		//already rendered with the table
+
+	case atom.Tfoot:
+		ctx.tableCtx.isInFooter = true
+		if err := ctx.traverseChildren(node); err != nil {
+			return err
 		}
+		ctx.tableCtx.isInFooter = false
 
-		return ctx.traverseChildren(node)
+	case atom.Tr:
+		ctx.tableCtx.body = append(ctx.tableCtx.body, []string{})
+		ctx.tableCtx.startRow()
+		if err := ctx.traverseChildren(node); err != nil {
+			return err
+		}
+		if !ctx.tableCtx.isInFooter {
+			row := ctx.tableCtx.body[ctx.tableCtx.tmpRow]
+			ctx.tableCtx.body[ctx.tableCtx.tmpRow] = ctx.tableCtx.skipSpanned(row)
+		}
+		ctx.tableCtx.tmpRow++
 
-	case atom.Pre:
-		ctx.emit("\n\n```\n")
-		ctx.isPre = true
-		err := ctx.traverseChildren(node)
-		ctx.isPre = false
-		ctx.emit("\n```\n\n")
-		return err
+	case atom.Th:
+		res, err := ctx.renderCell(node)
+		if err != nil {
+			return err
+		}
 
-	case atom.Style, atom.Script, atom.Head:
-		// Ignore the subtree.
-		return nil
+		colspan, rowspan := cellSpan(node, "colspan", maxColspan), cellSpan(node, "rowspan", maxRowspan)
+		ctx.tableCtx.header = ctx.tableCtx.addCell(ctx.tableCtx.header, res, colspan, rowspan)
+
+	case atom.Td:
+		res, err := ctx.renderCell(node)
+		if err != nil {
+			return err
+		}
+
+		colspan, rowspan := cellSpan(node, "colspan", maxColspan), cellSpan(node, "rowspan", maxRowspan)
+		if ctx.tableCtx.isInFooter {
+			ctx.tableCtx.footer = ctx.tableCtx.addCell(ctx.tableCtx.footer, res, colspan, rowspan)
+		} else {
+			row := ctx.tableCtx.body[ctx.tableCtx.tmpRow]
+			ctx.tableCtx.body[ctx.tableCtx.tmpRow] = ctx.tableCtx.addCell(row, res, colspan, rowspan)
+		}
 
-	default:
-		return ctx.traverseChildren(node)
 	}
+	return nil
 }
 
-// paragraphHandler renders node children surrounded by double newlines.
-func (ctx *TextifyTraverseContext) paragraphHandler(node *html.Node) error {
-	ctx.CheckFlushCitations()
-
-	if err := ctx.emit("\n\n"); err != nil {
-		return err
+// tableCaption returns the text of the caption of table, if it has one.
+func (ctx *TextifyTraverseContext) tableCaption(table *html.Node) (string, error) {
+	for c := table.FirstChild; c != nil; c = c.NextSibling {
+		if c.DataAtom != atom.Caption {
+			continue
+		}
+		testCtx := ctx.newTestContext()
+		if err := testCtx.traverseChildren(c); err != nil {
+			return "", err
+		}
+		ctx.adoptTestContext(&testCtx)
+		return strings.TrimSpace(spacingRe.ReplaceAllString(testCtx.buf.String(), " ")), nil
 	}
+	return "", nil
+}
 
-	if err := ctx.traverseChildren(node); err != nil {
-		return err
+// tableFences returns the text to emit before and after a pretty table, placing
+// any caption above or below it, and inside or outside the preformatted fence.
+// Nested tables are not fenced.
+func (ctx *TextifyTraverseContext) tableFences(caption string) (open, close string) {
+	fence := ctx.linkAccumulator.tableNestLevel == 0 && ctx.options.TableStyle != TableStyleMarkdown
+	open, close = "\n\n", "\n\n"
+	if fence {
+		open, close = "\n\n"+ctx.fence("")+"\n", ctx.fence("")+"\n\n"
 	}
-	if err := ctx.emit("\n\n"); err != nil {
-		return err
+	if caption == "" {
+		return open, close
 	}
 
-	return nil
+	inside := !fence || ctx.options.TableCaptionInFence
+	switch {
+	case !ctx.options.TableCaptionBelow && inside:
+		open += caption + "\n"
+	case !ctx.options.TableCaptionBelow:
+		open = "\n\n" + caption + "\n" + ctx.fence("") + "\n"
+	case inside:
+		close = caption + "\n" + close
+	default:
+		close = ctx.fence("") + "\n" + caption + "\n\n"
+	}
+	return open, close
 }
 
-// handleTableElement is only to be invoked when options.PrettyTables is active.
-func (ctx *TextifyTraverseContext) handleTableElement(node *html.Node) error {
-	if !ctx.options.PrettyTables {
-		panic("handleTableElement invoked when PrettyTables not active")
+// asciiTable renders the collected table data as an ASCII table.
+func (ctx *TextifyTraverseContext) asciiTable() string {
+	buf := &bytes.Buffer{}
+	table := tablewriter.NewWriter(buf)
+	if ctx.options.PrettyTablesOptions != nil {
+		options := ctx.options.PrettyTablesOptions
+		table.SetAutoFormatHeaders(options.AutoFormatHeader)
+		table.SetAutoWrapText(options.AutoWrapText)
+		table.SetReflowDuringAutoWrap(options.ReflowDuringAutoWrap)
+		table.SetColWidth(options.ColWidth)
+		table.SetColumnSeparator(options.ColumnSeparator)
+		table.SetRowSeparator(options.RowSeparator)
+		table.SetCenterSeparator(options.CenterSeparator)
+		table.SetHeaderAlignment(options.HeaderAlignment)
+		table.SetFooterAlignment(options.FooterAlignment)
+		table.SetAlignment(options.Alignment)
+		table.SetColumnAlignment(options.ColumnAlignment)
+		table.SetNewLine(options.NewLine)
+		table.SetHeaderLine(options.HeaderLine)
+		table.SetRowLine(options.RowLine)
+		table.SetAutoMergeCells(options.AutoMergeCells)
+		table.SetBorders(options.Borders)
+	}
+	header, footer, body := ctx.tableCtx.header, ctx.tableCtx.footer, ctx.tableCtx.body
+	if ctx.tableCtx.hasLineBreaks() {
+		//tablewriter would reflow the lines of a cell into one, so wrap each line
+		//here and keep the line breaks
+		colWidth := tablewriter.MAX_ROW_WIDTH
+		autoWrap := true
+		if options := ctx.options.PrettyTablesOptions; options != nil {
+			colWidth, autoWrap = options.ColWidth, options.AutoWrapText
+		}
+		if autoWrap {
+			header, footer = wrapCells(header, colWidth), wrapCells(footer, colWidth)
+			body = make([][]string, len(ctx.tableCtx.body))
+			for i, row := range ctx.tableCtx.body {
+				body[i] = wrapCells(row, colWidth)
+			}
+			table.SetAutoWrapText(false)
+		}
 	}
+	table.SetHeader(header)
+	table.SetFooter(footer)
+	table.AppendBulk(body)
 
-	switch node.DataAtom {
-	case atom.Table:
+	// Render the table using ASCII.
+	table.Render()
+	return buf.String()
+}
 
-		if ctx.linkAccumulator.tableNestLevel == 0 {
-			if err := ctx.emit("\n\n```\n"); err != nil {
-				return err
-			}
-		} else {
-			if err := ctx.emit("\n\n"); err != nil {
-				return err
+// hasLineBreaks reports whether any cell of the table has more than one line.
+func (tableCtx *tableTraverseContext) hasLineBreaks() bool {
+	rows := append([][]string{tableCtx.header, tableCtx.footer}, tableCtx.body...)
+	for _, row := range rows {
+		for _, cell := range row {
+			if strings.Contains(cell, "\n") {
+				return true
 			}
 		}
+	}
+	return false
+}
 
-		ctx.linkAccumulator.tableNestLevel++
+// wrapCells wraps each line of each cell in row on word boundaries to width.
+func wrapCells(row []string, width int) []string {
+	wrapped := make([]string, len(row))
+	for i, cell := range row {
+		var lines []string
+		for _, line := range strings.Split(cell, "\n") {
+			wrappedLines, _ := tablewriter.WrapString(line, width)
+			lines = append(lines, wrappedLines...)
+		}
+		wrapped[i] = strings.Join(lines, "\n")
+	}
+	return wrapped
+}
 
-		// Re-intialize all table context.
-		ctx.tableCtx.init()
+// markdown renders the table data as a Markdown style pipe table. As a pipe
+// table needs a header, the first row is used when the table has none.
+func (tableCtx *tableTraverseContext) markdown() string {
+	rows := append([][]string{}, tableCtx.body...)
+	header := tableCtx.header
+	if len(header) == 0 && len(rows) > 0 {
+		header, rows = rows[0], rows[1:]
+	}
+	if len(tableCtx.footer) > 0 {
+		rows = append(rows, tableCtx.footer)
+	}
+	if len(header) == 0 {
+		return ""
+	}
 
-		// Browse children, enriching context with table data.
-		if err := ctx.traverseChildren(node); err != nil {
-			return err
+	var sb strings.Builder
+	writeRow := func(row []string) {
+		sb.WriteString("|")
+		for _, cell := range row {
+			cell = strings.TrimSpace(spacingRe.ReplaceAllString(cell, " "))
+			sb.WriteString(" " + strings.ReplaceAll(cell, "|", "\\|") + " |")
+		}
+		sb.WriteString("\n")
+	}
+	writeRow(header)
+	sb.WriteString("|" + strings.Repeat("---|", len(header)) + "\n")
+	for _, row := range rows {
+		writeRow(row)
+	}
+	return sb.String()
+}
+
+func (ctx *TextifyTraverseContext) traverse(node *html.Node) error {
+	switch node.Type {
+	default:
+		return ctx.traverseChildren(node)
+
+	case html.TextNode:
+		data := node.Data
+		if ctx.options.StripInvisibleCharacters {
+			data = invisibleReplacer.Replace(data)
+		}
+		if ctx.options.NormalizeNBSP {
+			data = strings.ReplaceAll(data, "\u00a0", " ")
+		}
+		switch {
+		case ctx.isPre:
+			//kept as it is
+		case ctx.isCode:
+			//keep the spacing within inline code, but on a single line
+			data = lineBreakRe.ReplaceAllString(data, " ")
+		default:
+			data = strings.TrimSpace(spacingRe.ReplaceAllString(data, " "))
+			if ctx.options.NormalizePunctuation {
+				data = punctuationReplacer.Replace(data)
+			}
 		}
+		return ctx.emit(data)
+
+	case html.ElementNode:
+		return ctx.handleElement(node)
+	}
+}
 
-		buf := &bytes.Buffer{}
-		table := tablewriter.NewWriter(buf)
-		if ctx.options.PrettyTablesOptions != nil {
-			options := ctx.options.PrettyTablesOptions
-			table.SetAutoFormatHeaders(options.AutoFormatHeader)
-			table.SetAutoWrapText(options.AutoWrapText)
-			table.SetReflowDuringAutoWrap(options.ReflowDuringAutoWrap)
-			table.SetColWidth(options.ColWidth)
-			table.SetColumnSeparator(options.ColumnSeparator)
-			table.SetRowSeparator(options.RowSeparator)
-			table.SetCenterSeparator(options.CenterSeparator)
-			table.SetHeaderAlignment(options.HeaderAlignment)
-			table.SetFooterAlignment(options.FooterAlignment)
-			table.SetAlignment(options.Alignment)
-			table.SetColumnAlignment(options.ColumnAlignment)
-			table.SetNewLine(options.NewLine)
-			table.SetHeaderLine(options.HeaderLine)
-			table.SetRowLine(options.RowLine)
-			table.SetAutoMergeCells(options.AutoMergeCells)
-			table.SetBorders(options.Borders)
+func (ctx *TextifyTraverseContext) traverseChildren(node *html.Node) error {
+	ctx.depth++
+	defer func() {
+		ctx.depth--
+	}()
+	if maxDepth := ctx.maxDepth(); maxDepth > 0 && ctx.depth > maxDepth {
+		if ctx.options.TruncateAtMaxDepth {
+			//leave out anything nested more deeply
+			return nil
 		}
-		table.SetHeader(ctx.tableCtx.header)
-		table.SetFooter(ctx.tableCtx.footer)
-		table.AppendBulk(ctx.tableCtx.body)
+		return ErrMaxDepth
+	}
 
-		// Render the table using ASCII.
-		table.Render()
-		if err := ctx.emit(buf.String()); err != nil {
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if err := ctx.checkCancel(); err != nil {
+			return err
+		}
+		if run, end := ctx.linkRun(c); len(run) >= minLinkRun {
+			if err := ctx.emitLinkRun(run); err != nil {
+				return err
+			}
+			c = end
+			if next := c.NextSibling; next != nil && next.Type == html.TextNode {
+				//any separator or full stop ending the run goes with it
+				text := *next
+				text.Data = strings.TrimLeftFunc(text.Data, isRunEndRune)
+				if err := ctx.traverse(&text); err != nil {
+					return err
+				}
+				c = next
+			}
+			continue
+		}
+		if err := ctx.traverse(c); err != nil {
+			return err
+		}
+		if err := ctx.streamOutput(); err != nil {
 			return err
 		}
+	}
 
-		ctx.linkAccumulator.tableNestLevel--
+	return nil
+}
 
-		if ctx.linkAccumulator.tableNestLevel == 0 {
-			return ctx.emit("```\n\n")
-		} else {
-			return ctx.emit("\n\n")
+// linkRun returns the links in a row starting at node, such as those of a menu or a
+// tag cloud, with nothing but spacing and punctuation between them, when they are to
+// be compacted. end is the last node of the run, including any separator after it.
+func (ctx *TextifyTraverseContext) linkRun(node *html.Node) (run []*html.Node, end *html.Node) {
+	if !ctx.options.CompactLinkRuns || ctx.options.OmitLinks || ctx.linkStyle() == LinkStyleInline ||
+		ctx.options.ElementHandlers[atom.A] != nil || ctx.isPre || ctx.inlineLevel > 0 || ctx.inHeading ||
+		ctx.linkAccumulator.tableNestLevel > 0 || !ctx.isRunLink(node) {
+		return nil, nil
+	}
+
+	for c := node; c != nil; c = c.NextSibling {
+		switch {
+		case ctx.isRunLink(c):
+			run = append(run, c)
+		case c.Type == html.CommentNode, c.Type == html.TextNode && isSeparator(c.Data):
+		default:
+			return run, c.PrevSibling
 		}
+		end = c
+	}
+	return run, end
+}
+
+// isRunLink reports whether node is a link that may be part of a run of links.
+func (ctx *TextifyTraverseContext) isRunLink(node *html.Node) bool {
+	if node.Type != html.ElementNode || node.DataAtom != atom.A || ctx.isHidden(node) || ctx.isSkipped(node) {
+		return false
+	}
+	href := getAttrVal(node, "href")
+	return href != "" && !ctx.skipFragmentLink(href)
+}
+
+// isSeparator reports whether text is just spacing and punctuation, such as "|" or ", ".
+func isSeparator(text string) bool {
+	return strings.TrimFunc(text, isSeparatorRune) == ""
+}
+
+func isSeparatorRune(r rune) bool {
+	return unicode.IsSpace(r) || unicode.IsPunct(r) || unicode.IsSymbol(r)
+}
+
+// isRunEndRune reports whether r may be left over from a run of links, in the text
+// after it: spacing, a separator between the links, or the full stop ending a list of
+// them. Opening quotes and brackets belong to the text that follows.
+func isRunEndRune(r rune) bool {
+	switch r {
+	case '|', '·', '•', ',', ';', '.':
+		return true
+	}
+	return unicode.IsSpace(r)
+}
 
-	case atom.Tfoot:
-		ctx.tableCtx.isInFooter = true
-		if err := ctx.traverseChildren(node); err != nil {
+// emitLinkRun emits a run of links as a block of link lines, rather than as text with
+// a citation marker after each link.
+func (ctx *TextifyTraverseContext) emitLinkRun(run []*html.Node) error {
+	ctx.justClosedDiv = false
+	ctx.hasLinkRun = true
+	if ctx.lineLength > 0 {
+		if err := ctx.emit("\n"); err != nil {
 			return err
 		}
-		ctx.tableCtx.isInFooter = false
-
-	case atom.Tr:
-		ctx.tableCtx.body = append(ctx.tableCtx.body, []string{})
-		if err := ctx.traverseChildren(node); err != nil {
+	}
+	for _, a := range run {
+		testCtx := ctx.newTestContext()
+		if err := testCtx.traverseChildren(a); err != nil {
 			return err
 		}
-		ctx.tableCtx.tmpRow++
+		ctx.adoptTestContext(&testCtx)
 
-	case atom.Th:
-		res, err := ctx.renderEachChild(node)
-		if err != nil {
-			return err
+		href := ctx.normalizeHrefLink(getAttrVal(a, "href"))
+		if href == "" {
+			continue
 		}
-
-		ctx.tableCtx.header = append(ctx.tableCtx.header, res)
-
-	case atom.Td:
-		res, err := ctx.renderEachChild(node)
-		if err != nil {
+		display := strings.TrimSpace(spacingRe.ReplaceAllString(testCtx.buf.String(), " "))
+		if err := ctx.emitLinkLine(escapeLink(href), display); err != nil {
 			return err
 		}
-
-		if ctx.tableCtx.isInFooter {
-			ctx.tableCtx.footer = append(ctx.tableCtx.footer, res)
-		} else {
-			ctx.tableCtx.body[ctx.tableCtx.tmpRow] = append(ctx.tableCtx.body[ctx.tableCtx.tmpRow], res)
-		}
-
 	}
 	return nil
 }
 
-func (ctx *TextifyTraverseContext) traverse(node *html.Node) error {
-	switch node.Type {
+// maxDepth returns the greatest depth of nesting that is rendered, or 0 for no limit.
+func (ctx *TextifyTraverseContext) maxDepth() int {
+	switch {
+	case ctx.options.MaxDepth < 0:
+		return 0
+	case ctx.options.MaxDepth == 0:
+		return defaultMaxDepth
 	default:
-		return ctx.traverseChildren(node)
-
-	case html.TextNode:
-		var data string
-		if ctx.isPre {
-			data = node.Data
-		} else {
-			data = strings.TrimSpace(spacingRe.ReplaceAllString(node.Data, " "))
-		}
-		return ctx.emit(data)
-
-	case html.ElementNode:
-		return ctx.handleElement(node)
+		return ctx.options.MaxDepth
 	}
 }
 
-func (ctx *TextifyTraverseContext) traverseChildren(node *html.Node) error {
-	for c := node.FirstChild; c != nil; c = c.NextSibling {
-		if err := ctx.traverse(c); err != nil {
-			return err
-		}
+// maxDataURILength returns the longest data: URI that is linked, or 0 for no limit.
+func (ctx *TextifyTraverseContext) maxDataURILength() int {
+	switch {
+	case ctx.options.MaxDataURILength < 0:
+		return 0
+	case ctx.options.MaxDataURILength == 0:
+		return defaultMaxDataURILength
+	default:
+		return ctx.options.MaxDataURILength
 	}
+}
 
-	return nil
+// checkCancel returns the error of the cancel context, checking it once every
+// cancelCheckInterval nodes as that is not free.
+func (ctx *TextifyTraverseContext) checkCancel() error {
+	if ctx.cancel == nil {
+		return nil
+	}
+	ctx.visited++
+	if ctx.visited%cancelCheckInterval != 0 {
+		return nil
+	}
+	return ctx.cancel.Err()
 }
 
 // Tests r for being a character where no space should be inserted in front of.
@@ -640,81 +3439,438 @@ func (ctx *TextifyTraverseContext) emit(data string) error {
 		return nil
 	}
 
-	var lines = []string{data}
-
-	for _, line := range lines {
-		runes := []rune(line)
-		startsWithSpace := unicode.IsSpace(runes[0]) || punctNoSpaceBefore(runes[0])
-		if !startsWithSpace && !ctx.endsWithSpace {
+	first, _ := utf8.DecodeRuneInString(data)
+	last, _ := utf8.DecodeLastRuneInString(data)
+	if first == '\n' && ctx.lineLength > 0 && !ctx.isPre {
+		ctx.trimIndentLine()
+	}
+	startsWithSpace := unicode.IsSpace(first) || punctNoSpaceBefore(first)
+	if !startsWithSpace && !ctx.endsWithSpace && ctx.lineLength > 0 && !ctx.isPre {
+		if ctx.lineLength >= quoteLineWidth && ctx.wrapsQuote(data) {
+			//the line of quoted text is full, so the word goes on the next one
+			if err := ctx.breakQuoteLine(); err != nil {
+				return err
+			}
+		} else {
 			if err := ctx.buf.WriteByte(' '); err != nil {
 				return err
 			}
 			ctx.lineLength++
 		}
-		ctx.endsWithSpace = unicode.IsSpace(runes[len(runes)-1]) || punctNoSpaceAfter(runes[len(runes)-1])
-		for _, c := range line {
-			if _, err := ctx.buf.WriteString(string(c)); err != nil {
+	}
+	ctx.endsWithSpace = unicode.IsSpace(last) || punctNoSpaceAfter(last)
+
+	//write a line at a time, each new line starting with the prefix
+	for data != "" {
+		line := data
+		if i := strings.IndexByte(data, '\n'); i >= 0 {
+			line = data[:i+1]
+		}
+		data = data[len(line):]
+
+		if ctx.wrapsQuote(line) {
+			var err error
+			if line, err = ctx.fitQuoteLine(line); err != nil {
 				return err
 			}
-			ctx.lineLength++
-			if c == '\n' {
-				ctx.lineLength = 0
-				if ctx.prefix != "" {
-					if _, err := ctx.buf.WriteString(ctx.prefix); err != nil {
-						return err
-					}
-				}
+		}
+		if _, err := ctx.buf.WriteString(line); err != nil {
+			return err
+		}
+		if strings.IndexFunc(line, isTextRune) >= 0 {
+			ctx.breakRun = 0
+		}
+		if line[len(line)-1] != '\n' {
+			ctx.lineLength += utf8.RuneCountInString(line)
+			break
+		}
+		ctx.lineLength = 0
+		if _, err := ctx.buf.WriteString(ctx.prefix); err != nil {
+			return err
+		}
+	}
+	return ctx.checkOutputSize()
+}
+
+// wrapsQuote reports whether data goes on a line of quoted text that is to be broken
+// to fit quoteLineWidth, rather than on a link line, heading or other kind of line, or
+// within preformatted text or a table.
+func (ctx *TextifyTraverseContext) wrapsQuote(data string) bool {
+	if ctx.blockquoteLevel == 0 || ctx.prefix == "" || ctx.options.WrapWidth > 0 || ctx.isPre || ctx.linkAccumulator.tableNestLevel > 0 {
+		return false
+	}
+	text := ctx.buf.Bytes()
+	line := bytes.TrimPrefix(text[bytes.LastIndexByte(text, '\n')+1:], []byte(ctx.prefix))
+	words := strings.Fields(string(line) + data)
+	return len(words) == 0 || !startsLineType(words[0])
+}
+
+// fitQuoteLine breaks a line of quoted text for as long as it is too long, on the last
+// space that keeps it within quoteLineWidth or, failing that, on the first, so that a
+// word too long to fit stays whole. It returns the rest of the line, to be written.
+func (ctx *TextifyTraverseContext) fitQuoteLine(line string) (string, error) {
+	newline := ""
+	if strings.HasSuffix(line, "\n") {
+		line, newline = line[:len(line)-1], "\n"
+	}
+	for {
+		text := []rune(line)
+		room := quoteLineWidth - ctx.lineLength
+		if len(text) <= room {
+			break
+		}
+		i := room
+		for i >= 0 && text[i] != ' ' {
+			i--
+		}
+		if i < 0 || (ctx.lineLength == 0 && strings.TrimSpace(string(text[:i])) == "") {
+			//nothing fits, so the line runs on to the end of the word
+			i = 0
+			for i < len(text) && text[i] == ' ' {
+				i++
+			}
+			for i < len(text) && text[i] != ' ' {
+				i++
 			}
 		}
+		head, rest := strings.TrimRight(string(text[:i]), " "), strings.TrimLeft(string(text[i:]), " ")
+		if rest == "" {
+			break
+		}
+		if _, err := ctx.buf.WriteString(head); err != nil {
+			return "", err
+		}
+		if err := ctx.breakQuoteLine(); err != nil {
+			return "", err
+		}
+		line = rest
 	}
-	return nil
+	return line + newline, nil
+}
+
+// breakQuoteLine starts another line of the quote, recording where so that the text
+// can be joined up again.
+func (ctx *TextifyTraverseContext) breakQuoteLine() error {
+	ctx.quoteBreaks = append(ctx.quoteBreaks, ctx.buf.Len())
+	ctx.lineLength = 0
+	_, err := ctx.buf.WriteString("\n" + ctx.prefix)
+	return err
+}
+
+// dropQuoteBreaks forgets the breaks in quoted text from size on, that text having been
+// taken back.
+func (ctx *TextifyTraverseContext) dropQuoteBreaks(size int) {
+	for len(ctx.quoteBreaks) > 0 && ctx.quoteBreaks[len(ctx.quoteBreaks)-1] >= size {
+		ctx.quoteBreaks = ctx.quoteBreaks[:len(ctx.quoteBreaks)-1]
+	}
+}
+
+// trimIndentLine takes back the indent of the current line when nothing has followed
+// it, as when a definition starts with a nested list, so as not to end a line of
+// nothing but spaces.
+func (ctx *TextifyTraverseContext) trimIndentLine() {
+	text := ctx.buf.Bytes()
+	line := text[bytes.LastIndexByte(text, '\n')+1:]
+	line = bytes.TrimPrefix(line, []byte(ctx.prefix))
+	if len(line) > 0 && len(bytes.TrimLeft(line, " \t")) == 0 {
+		ctx.buf.Truncate(len(text) - len(line))
+		ctx.lineLength = 0
+	}
+}
+
+// hasLeadingSpace reports whether text is empty or starts with spacing.
+func hasLeadingSpace(text string) bool {
+	r, _ := utf8.DecodeRuneInString(text)
+	return text == "" || unicode.IsSpace(r)
+}
+
+// hasTrailingSpace reports whether text is empty or ends with spacing.
+func hasTrailingSpace(text string) bool {
+	r, _ := utf8.DecodeLastRuneInString(text)
+	return text == "" || unicode.IsSpace(r)
+}
+
+// isTextRune reports whether r is visible text, rather than spacing.
+func isTextRune(r rune) bool {
+	return !isSpacing(r)
+}
+
+// isSpacing reports whether r is spacing, a blank line mark included.
+func isSpacing(r rune) bool {
+	return unicode.IsSpace(r) || r == blankLineRune
+}
+
+// emitLinkLine emits a gemini link line, recording the link.
+func (ctx *TextifyTraverseContext) emitLinkLine(url string, display string) error {
+	ctx.links = append(ctx.links, Link{URL: url, Display: strings.TrimSpace(strings.ReplaceAll(display, blankLineMark, ""))})
+	return ctx.emit("=> " + url + ctx.linkLineSeparator() + display + "\n")
+}
+
+// Links returns the links found in the document so far, in document order.
+func (ctx *TextifyTraverseContext) Links() []Link {
+	return append([]Link(nil), ctx.links...)
+}
+
+// Emit writes text to the output, separated by a space from any preceding text.
+func (ctx *TextifyTraverseContext) Emit(text string) error {
+	return ctx.emit(text)
+}
+
+// EmitChildren renders the children of node with the usual handling.
+func (ctx *TextifyTraverseContext) EmitChildren(node *html.Node) error {
+	return ctx.traverseChildren(node)
+}
+
+// EmitLink adds a link to href to the citations, emitting its citation marker.
+func (ctx *TextifyTraverseContext) EmitLink(href string, display string) error {
+	if ctx.skipFragmentLink(href) {
+		return nil
+	}
+	href = ctx.normalizeHrefLink(href)
+	if ctx.options.OmitLinks || href == "" {
+		return nil
+	}
+	return ctx.emitCitation(href, display, false)
+}
+
+// emitAttached emits data straight after the preceding text, without the separating
+// space emit would otherwise insert.
+func (ctx *TextifyTraverseContext) emitAttached(data string) error {
+	if data == "" {
+		return nil
+	}
+	ctx.endsWithSpace = true
+	return ctx.emit(data)
 }
 
 func (ctx *TextifyTraverseContext) normalizeHrefLink(link string) string {
 	link = strings.TrimSpace(link)
+	if hasScheme(link, "javascript") {
+		return ""
+	}
+	if hasScheme(link, "data") && ctx.maxDataURILength() > 0 && len(link) > ctx.maxDataURILength() {
+		return ""
+	}
+	if ctx.baseURL != nil {
+		if ref, err := url.Parse(link); err == nil {
+			//the host is converted first, as serialising would percent-encode it
+			resolved := ctx.baseURL.ResolveReference(ref)
+			asciiHost(resolved)
+			link = resolved.String()
+		}
+	}
 	link = strings.TrimPrefix(link, "mailto:")
+	link = encodeIRI(link)
+	if ctx.options.LinkRewriter != nil && link != "" {
+		link = ctx.options.LinkRewriter(link)
+	}
 	return link
 }
 
-func formatGeminiCitation(idx int, showMarker bool) string {
+// encodeIRI converts an internationalised link to a plain URI that gemini clients can
+// follow: a non-ASCII host is converted to punycode and any other non-ASCII characters
+// are percent-encoded.
+func encodeIRI(link string) string {
+	if u, err := url.Parse(link); err == nil && asciiHost(u) {
+		link = u.String()
+	}
+	return escapeLink(link)
+}
+
+// asciiHost converts a non-ASCII host of u to punycode, reporting whether it did.
+func asciiHost(u *url.URL) bool {
+	host := u.Hostname()
+	if isASCII(host) {
+		return false
+	}
+	ascii, err := idna.ToASCII(strings.ToLower(host))
+	if err != nil {
+		return false
+	}
+	if port := u.Port(); port != "" {
+		ascii += ":" + port
+	}
+	u.Host = ascii
+	return true
+}
+
+// escapeLink percent-encodes the characters that may not appear in a gemini link line:
+// spaces, control and non-ASCII characters, and any % that does not start a valid
+// escape. Escapes already present are kept, so escaping a link twice leaves it as it is.
+func escapeLink(link string) string {
+	var b strings.Builder
+	for i := 0; i < len(link); i++ {
+		c := link[i]
+		switch {
+		case c == '%' && i+2 < len(link) && isHex(link[i+1]) && isHex(link[i+2]):
+			b.WriteByte(c)
+		case c <= ' ' || c == '%' || c >= 0x7f:
+			fmt.Fprintf(&b, "%%%02X", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// isHex reports whether c is a hexadecimal digit.
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// isASCII reports whether s consists only of ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// hasScheme reports whether link uses the given URL scheme.
+func hasScheme(link string, scheme string) bool {
+	link = strings.TrimSpace(link)
+	return len(link) > len(scheme) && link[len(scheme)] == ':' && strings.EqualFold(link[:len(scheme)], scheme)
+}
+
+// skipFragmentLink reports whether link is a bookmark within the same page that is
+// to be omitted, there being no base URL to resolve it against.
+func (ctx *TextifyTraverseContext) skipFragmentLink(link string) bool {
+	return !ctx.options.KeepFragmentLinks && ctx.baseURL == nil && strings.HasPrefix(strings.TrimSpace(link), "#")
+}
+
+// initBaseURL sets the URL that relative links are resolved against. A <base> element
+// in the document takes precedence over the BaseURL option, and is itself resolved
+// against it.
+func (ctx *TextifyTraverseContext) initBaseURL(doc *html.Node) error {
+	if ctx.baseURL == nil && ctx.options.BaseURL != "" {
+		base, err := url.Parse(ctx.options.BaseURL)
+		if err != nil {
+			return err
+		}
+		ctx.baseURL = base
+	}
+
+	if href := strings.TrimSpace(findBaseHref(doc)); href != "" {
+		base, err := url.Parse(href)
+		if err != nil {
+			//ignore a malformed <base> element
+			return nil
+		}
+		if ctx.baseURL != nil {
+			base = ctx.baseURL.ResolveReference(base)
+		}
+		ctx.baseURL = base
+	}
+	return nil
+}
+
+// findBaseHref returns the href of the first <base> element in the document, if any.
+func findBaseHref(node *html.Node) string {
+	if node.Type == html.ElementNode && node.DataAtom == atom.Base {
+		if href := getAttrVal(node, "href"); href != "" {
+			return href
+		}
+	}
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if href := findBaseHref(c); href != "" {
+			return href
+		}
+	}
+	return ""
+}
+
+func (ctx *TextifyTraverseContext) formatGeminiCitation(idx int, showMarker bool) string {
 	if showMarker {
-		return fmt.Sprintf("[%d]", idx)
+		format := ctx.options.CitationMarkerFormat
+		if !strings.Contains(format, "%d") {
+			format = defaultCitationMarkerFormat
+		}
+		label := strconv.Itoa(idx)
+		if ctx.options.CitationStyle == CitationStyleSymbol && idx > 0 {
+			label = citationSymbol(idx)
+		}
+		return strings.Replace(format, "%d", label, 1)
 	} else {
 		return ""
 	}
 
 }
 
-func (ctx *TextifyTraverseContext) addGeminiCitation(url string, display string) string {
+// citationSymbol returns the footnote symbol for the citation numbered n, from 1: each
+// symbol in turn, then each doubled and so on.
+func citationSymbol(n int) string {
+	n--
+	return strings.Repeat(citationSymbols[n%len(citationSymbols)], n/len(citationSymbols)+1)
+}
 
-	if url[0:1] == "#" {
-		//dont emit bookmarks to the same page (url starts #)
-		return ""
+// emitCitation adds a citation for url and emits its marker, noting where it went.
+// Sources of images, video or audio are media citations.
+func (ctx *TextifyTraverseContext) emitCitation(url string, display string, media bool) error {
+	marker, cited := ctx.addCitation(url, display, media)
+	start := ctx.buf.Len()
+	if err := ctx.emit(marker); err != nil {
+		return err
+	}
+	if cited {
+		ctx.citations = append(ctx.citations, citationMark{url: escapeLink(url), start: start, end: ctx.buf.Len()})
+	}
+	return nil
+}
+
+// addCitation adds a citation for url, returning its marker and whether it was cited,
+// rather than left out or put in the text.
+func (ctx *TextifyTraverseContext) addCitation(url string, display string, media bool) (string, bool) {
+
+	if url == "" || ctx.skipFragmentLink(url) {
+		//dont emit bookmarks to the same page (url starts #), unless they are wanted
+		return "", false
+	} else if ctx.linkStyle() == LinkStyleInline {
+		//the url goes in the text, so there is nothing to cite
+		url = escapeLink(url)
+		ctx.links = append(ctx.links, Link{URL: url, Display: display, Media: media})
+		return "(" + url + ")", false
 	} else {
 		citation := citationLink{
-			index:   len(ctx.linkAccumulator.linkArray) + ctx.options.CitationStart,
+			index:   ctx.nextCitationIndex(),
 			display: display,
 			url:     url,
+			media:   media,
 		}
 
-		//spaces would mess up the gemini link, so check for them
-		if strings.Contains(citation.url, " ") {
-			//escape the spaces
-			citation.url = strings.ReplaceAll(citation.url, " ", "%20")
+		//spaces would mess up the gemini link, so escape them along with anything
+		//else that is not allowed, such as from a LinkRewriter
+		citation.url = escapeLink(citation.url)
 
+		if ctx.options.DeduplicateLinks {
+			if index, ok := ctx.linkAccumulator.urlIndex[citation.url]; ok {
+				return ctx.formatGeminiCitation(index, ctx.citationMarkers()), true
+			}
+			if ctx.linkAccumulator.urlIndex == nil {
+				ctx.linkAccumulator.urlIndex = map[string]int{}
+			}
+			ctx.linkAccumulator.urlIndex[citation.url] = citation.index
 		}
+
 		ctx.linkAccumulator.linkArray = append(ctx.linkAccumulator.linkArray, citation)
-		return formatGeminiCitation(citation.index, ctx.options.CitationMarkers)
+		ctx.links = append(ctx.links, Link{Index: citation.index, URL: citation.url, Display: citation.display, Media: media})
+		return ctx.formatGeminiCitation(citation.index, ctx.citationMarkers()), true
 	}
 
 }
 
-func (ctx *TextifyTraverseContext) forceFlushGeminiCitations() {
+// citationMarkers reports whether citations are marked in the text.
+func (ctx *TextifyTraverseContext) citationMarkers() bool {
+	return ctx.options.CitationStyle != CitationStyleNone && ctx.linkStyle() != LinkStyleFootnoteImmediate
+}
+
+func (ctx *TextifyTraverseContext) forceFlushGeminiCitations() error {
 	// this method writes to the buffer directly instead of using `emit`, b/c we do not want to split long links
 
 	if ctx.linkAccumulator.tableNestLevel > 0 {
 		//dont emit citation list inside a table
-		return
+		return nil
 	}
 
 	ctx.buf.WriteString("\n")
@@ -723,54 +3879,205 @@ func (ctx *TextifyTraverseContext) forceFlushGeminiCitations() {
 	//ctx.buf.WriteString(formatGeminiCitation(ctx.linkAccumulator.flushedToIndex))
 	ctx.buf.WriteByte('\n')
 
-	for i, link := range ctx.linkAccumulator.linkArray {
-		//	ctx.buf.WriteString(formatGeminiCitation(i))
-
-		if i > ctx.linkAccumulator.flushedToIndex {
-			ctx.buf.WriteString("=> ")
-			ctx.buf.WriteString(link.url)
-			ctx.buf.WriteByte(' ')
-			ctx.buf.WriteString(formatGeminiCitation(link.index, ctx.options.NumberedLinks))
-			ctx.buf.WriteByte(' ')
-			ctx.buf.WriteString(link.display)
+	unflushed := ctx.linkAccumulator.linkArray[ctx.linkAccumulator.flushedToIndex+1:]
+	if ctx.options.GroupMediaLinks {
+		//the media links go in a block of their own after the others
+		var pages, media []citationLink
+		for _, link := range unflushed {
+			if link.media {
+				media = append(media, link)
+			} else {
+				pages = append(pages, link)
+			}
+		}
+		for _, link := range pages {
+			if err := ctx.writeCitationLink(link); err != nil {
+				return err
+			}
+		}
+		if len(pages) > 0 && len(media) > 0 {
 			ctx.buf.WriteByte('\n')
 		}
+		for _, link := range media {
+			if err := ctx.writeCitationLink(link); err != nil {
+				return err
+			}
+		}
+	} else {
+		for _, link := range unflushed {
+			if err := ctx.writeCitationLink(link); err != nil {
+				return err
+			}
+		}
 	}
 
 	ctx.buf.WriteByte('\n')
+	ctx.lineLength = 0
 
 	ctx.ResetCitationCounters()
 
+	return nil
+}
+
+// writeCitationLink writes the link line for a citation.
+func (ctx *TextifyTraverseContext) writeCitationLink(link citationLink) error {
+	//the separator after the url, then a single space between each other field present
+	var fields []string
+	if prefix := ctx.options.MediaLinkPrefix; link.media && prefix != "" {
+		fields = append(fields, prefix)
+	}
+	if marker := ctx.formatGeminiCitation(link.index, ctx.citationMarkers()); marker != "" {
+		fields = append(fields, marker)
+	}
+	if display := strings.TrimSpace(link.display); display != "" && !ctx.options.OmitLinkDisplay {
+		fields = append(fields, display)
+	}
+
+	ctx.buf.WriteString("=> ")
+	ctx.buf.WriteString(link.url)
+	if len(fields) > 0 {
+		ctx.buf.WriteString(ctx.linkLineSeparator())
+		ctx.buf.WriteString(strings.Join(fields, " "))
+	}
+	ctx.buf.WriteByte('\n')
+	return ctx.checkOutputSize()
+}
+
+// linkLineSeparator returns the whitespace between the url of a link line and its text,
+// a single space unless the separator wanted is spaces and tabs.
+func (ctx *TextifyTraverseContext) linkLineSeparator() string {
+	sep := ctx.options.LinkLineSeparator
+	if sep == "" || strings.Trim(sep, " \t") != "" {
+		return " "
+	}
+	return sep
 }
-func (ctx *TextifyTraverseContext) emitGeminiCitations() {
 
-	if len(ctx.linkAccumulator.linkArray) > ctx.linkAccumulator.flushedToIndex {
+func (ctx *TextifyTraverseContext) emitGeminiCitations() error {
+
+	if len(ctx.linkAccumulator.linkArray) > ctx.linkAccumulator.flushedToIndex+1 {
 		//there are unflushed links
-		ctx.forceFlushGeminiCitations()
+		return ctx.forceFlushGeminiCitations()
 	}
+	return nil
 }
 
-// renderEachChild visits each direct child of a node and collects the sequence of
-// textuual representaitons separated by a single newline.
-func (ctx *TextifyTraverseContext) renderEachChild(node *html.Node) (string, error) {
-	buf := &bytes.Buffer{}
-	for c := node.FirstChild; c != nil; c = c.NextSibling {
-		s, err := FromHTMLNode(c, *ctx)
-		if err != nil {
-			return "", err
+// renderCell renders the content of a table cell on its own with a clean context,
+// with a line for each line break or block within it. Its citations are numbered
+// on from those already gathered, and added to them.
+func (ctx *TextifyTraverseContext) renderCell(node *html.Node) (string, error) {
+	options := ctx.options
+	options.CitationStart = ctx.nextCitationIndex()
+	options.WrapWidth = 0
+
+	cellCtx := TextifyTraverseContext{
+		options:       options,
+		baseURL:       ctx.baseURL,
+		abbreviations: ctx.abbreviations,
+		cancel:        ctx.cancel,
+		depth:         ctx.depth,
+		inAppendix:    ctx.inAppendix,
+	}
+	cellCtx.linkAccumulator = *newlinkAccumulator()
+	cellCtx.linkAccumulator.tableNestLevel = ctx.linkAccumulator.tableNestLevel
+	cellCtx.linkAccumulator.urlIndex = ctx.linkAccumulator.urlIndex
+
+	if err := cellCtx.traverseChildren(node); err != nil {
+		return "", err
+	}
+
+	ctx.linkAccumulator.linkArray = append(ctx.linkAccumulator.linkArray, cellCtx.linkAccumulator.linkArray...)
+	for _, mark := range cellCtx.citations {
+		//the markers go in the table, which is yet to be emitted
+		ctx.citations = append(ctx.citations, citationMark{url: mark.url, start: ctx.buf.Len(), end: ctx.buf.Len()})
+	}
+	ctx.linkAccumulator.urlIndex = cellCtx.linkAccumulator.urlIndex
+	ctx.links = append(ctx.links, cellCtx.links...)
+	ctx.abbreviations = cellCtx.abbreviations
+	ctx.counts.add(cellCtx.counts)
+	ctx.appendix = append(ctx.appendix, cellCtx.appendix...)
+
+	//the lines of a cell are neither kept apart nor left out of the table
+	text := strings.NewReplacer(blankLineMark, "", fenceMark, "").Replace(cellCtx.buf.String())
+	return strings.TrimSpace(cellBreakRe.ReplaceAllString(text, "\n")), nil
+}
+
+// isHidden reports whether node is marked as not to be shown, by the hidden attribute,
+// when RespectAria is set by aria-hidden, or when RespectInlineDisplayNone is set by
+// its inline style.
+func (ctx *TextifyTraverseContext) isHidden(node *html.Node) bool {
+	if hasAttr(node, "hidden") && !strings.EqualFold(getAttrVal(node, "hidden"), "until-found") {
+		return true
+	}
+	if ctx.options.RespectAria && strings.EqualFold(strings.TrimSpace(getAttrVal(node, "aria-hidden")), "true") {
+		return true
+	}
+	if !ctx.options.RespectInlineDisplayNone {
+		return false
+	}
+
+	for _, declaration := range strings.Split(getAttrVal(node, "style"), ";") {
+		parts := strings.SplitN(declaration, ":", 2)
+		if len(parts) != 2 {
+			continue
 		}
-		if _, err = buf.WriteString(s); err != nil {
-			return "", err
+		property := strings.ToLower(strings.TrimSpace(parts[0]))
+		value := strings.ToLower(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(parts[1]), "!important")))
+		if (property == "display" && value == "none") || (property == "visibility" && value == "hidden") {
+			return true
+		}
+	}
+	return false
+}
+
+// isPresentational reports whether node has a presentation role, marking it as
+// decorative.
+func isPresentational(node *html.Node) bool {
+	role := strings.ToLower(strings.TrimSpace(getAttrVal(node, "role")))
+	return role == "presentation" || role == "none"
+}
+
+// isSkipped reports whether node is one of the elements, classes or ids to be omitted.
+func (ctx *TextifyTraverseContext) isSkipped(node *html.Node) bool {
+	for _, name := range ctx.options.SkipElements {
+		if strings.EqualFold(node.Data, name) {
+			return true
 		}
-		if c.NextSibling != nil {
-			if err = buf.WriteByte('\n'); err != nil {
-				return "", err
+	}
+
+	if len(ctx.options.SkipClasses) > 0 {
+		for _, class := range strings.Fields(getAttrVal(node, "class")) {
+			for _, skip := range ctx.options.SkipClasses {
+				if class == skip {
+					return true
+				}
 			}
 		}
 	}
-	return buf.String(), nil
+
+	if id := getAttrVal(node, "id"); id != "" {
+		for _, skip := range ctx.options.SkipIDs {
+			if id == skip {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hasAttr(node *html.Node, attrName string) bool {
+	for _, attr := range node.Attr {
+		if attr.Key == attrName {
+			return true
+		}
+	}
+
+	return false
 }
 
+// getAttrVal returns the value of an attribute of node, or "" if it has none. The
+// parser has already decoded any character references in the value, so an href of
+// "a.php?x=1&amp;y=2" is "a.php?x=1&y=2" here and in the links made from it.
 func getAttrVal(node *html.Node, attrName string) string {
 	for _, attr := range node.Attr {
 		if attr.Key == attrName {
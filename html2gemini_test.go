@@ -2,13 +2,19 @@ package html2gemini
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path"
+	"reflect"
 	"regexp"
 	"strings"
 	"testing"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
 )
 
 const destPath = "testdata"
@@ -144,6 +150,14 @@ func TestParagraphsAndBreaks(t *testing.T) {
 			"<pre>test1\ntest 2\n\ntest  3</pre>",
 			"```\ntest1\ntest 2\n\ntest  3\n```",
 		},
+		{
+			"<pre>line1<br>line2</pre>",
+			"```\nline1\nline2\n```",
+		},
+		{
+			"<pre>line1<br>line<span>2</span></pre>",
+			"```\nline1\nline2\n```",
+		},
 	}
 
 	for _, testCase := range testCases {
@@ -442,22 +456,48 @@ func TestLinkEscaping(t *testing.T) {
 	}{
 		{
 			`<a href="foo">display</a>`,
-			"display\n\n=> foo  display",		//minor bug with extra space at present
+			"display\n\n=> foo display",
 		},
 		{
 			`<a href="foo spaced">display</a>`,
-			"display\n\n=> foo%20spaced  display",		//minor bug with extra space at present
+			"display\n\n=> foo%20spaced display",
 		},
 		{
 			`<a href="foo?bar+baz">display</a>`,
-			"display\n\n=> foo?bar+baz  display",		//minor bug with extra space at present
+			"display\n\n=> foo?bar+baz display",
+		},
+		{
+			`<a href="https://例え.jp/ページ">display</a>`,
+			"display\n\n=> https://xn--r8jz45g.jp/%E3%83%9A%E3%83%BC%E3%82%B8 display",
+		},
+		{
+			`<a href="http://Bücher.example:8080/café?q=crème#résumé">display</a>`,
+			"display\n\n=> http://xn--bcher-kva.example:8080/caf%C3%A9?q=cr%C3%A8me#r%C3%A9sum%C3%A9 display",
+		},
+		{
+			`<a href="/caf%C3%A9">display</a>`,
+			"display\n\n=> /caf%C3%A9 display",
+		},
+		{
+			`<a href="foo%20spaced and%2fslashed">display</a>`,
+			"display\n\n=> foo%20spaced%20and%2fslashed display",
+		},
+		{
+			`<a href="100% off%zz">display</a>`,
+			"display\n\n=> 100%25%20off%25zz display",
 		},
 	}
-	for _, testCase := range testCases {
-		if msg, err := wantString(testCase.input, testCase.output); err != nil {
-			t.Error(err)
-		} else if len(msg) > 0 {
-			t.Log(msg)
+	//whatever the style, the link line has the same marker as the text, with a single
+	//space between each of its fields
+	markers := map[CitationStyle]string{CitationStyleNone: "", CitationStyleNumbered: " [1]", CitationStyleSymbol: " [*]"}
+	for style, marker := range markers {
+		marked := strings.NewReplacer("display\n", "display"+marker+"\n", " display", marker+" display")
+		for _, testCase := range testCases {
+			if msg, err := wantString(testCase.input, marked.Replace(testCase.output), Options{CitationStyle: style}); err != nil {
+				t.Error(err)
+			} else if len(msg) > 0 {
+				t.Log(msg)
+			}
 		}
 	}
 }
@@ -543,22 +583,23 @@ func TestImageAltTags(t *testing.T) {
 			`<img src="http://example.ru/hello.jpg" alt="Example"/>`,
 			``,
 		},
-		// Images do matter if they are in a link.
+		// Images do matter if they are in a link, which is named by the alt text.
 		{
 			`<a href="http://example.com/"><img src="http://example.ru/hello.jpg" alt="Example"/></a>`,
-			`Example [1]\n\n=> http://example.com/ [1] Example`,
+			"[ Example]\n\n=> http://example.com/ Example",
 		},
 		{
 			`<a href="http://example.com/"><img src="http://example.ru/hello.jpg" alt="Example"></a>`,
-			`Example ( http://example.com/ )`,
+			"[ Example]\n\n=> http://example.com/ Example",
 		},
 		{
 			`<a href='http://example.com/'><img src='http://example.ru/hello.jpg' alt='Example'/></a>`,
-			`Example ( http://example.com/ )`,
+			"[ Example]\n\n=> http://example.com/ Example",
 		},
 		{
-			`<a href='http://example.com/'><img src='http://example.ru/hello.jpg' alt='Example'></a>`,
-			`Example ( http://example.com/ )`,
+			`<a href='http://example.com/'><img src='http://example.ru/hello.jpg' alt='Ex
+  ample'></a>`,
+			"[ Ex ample]\n\n=> http://example.com/ Ex ample",
 		},
 	}
 
@@ -569,6 +610,29 @@ func TestImageAltTags(t *testing.T) {
 			t.Log(msg)
 		}
 	}
+
+	//the image has its own citation, and without alt text the link is marked by EmptyLinkPrefix
+	linkTestCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			`<a href="http://example.com/"><img src="http://example.ru/hello.jpg" alt="Example"></a>`,
+			"[‡ Example] [1] [2]\n\n=> http://example.ru/hello.jpg [1] [‡ Example]\n=> http://example.com/ [2] Example",
+		},
+		{
+			`<a href="http://example.com/"><img src="http://example.ru/hello.jpg"></a>`,
+			"[‡ hello] [1] >> [2]\n\n=> http://example.ru/hello.jpg [1] [‡ hello]\n=> http://example.com/ [2] >>",
+		},
+	}
+
+	for _, testCase := range linkTestCases {
+		if msg, err := wantString(testCase.input, testCase.output, *NewOptions()); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
 }
 
 func TestHeadings(t *testing.T) {
@@ -640,13 +704,20 @@ func TestBold(t *testing.T) {
 	}
 
 	for _, testCase := range testCases {
-		if msg, err := wantString(testCase.input, testCase.output); err != nil {
+		if msg, err := wantString(testCase.input, testCase.output, Options{BoldMarker: "*"}); err != nil {
 			t.Error(err)
 		} else if len(msg) > 0 {
 			t.Log(msg)
 		}
 	}
 
+	//without a marker the text is left as it is
+	if msg, err := wantString("<b>Test</b> <strong>Test</strong>", "Test Test"); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+
 }
 
 func TestDiv(t *testing.T) {
@@ -693,42 +764,57 @@ func TestBlockquotes(t *testing.T) {
 	}{
 		{
 			"<div>level 0<blockquote>level 1<br><blockquote>level 2</blockquote>level 1</blockquote><div>level 0</div></div>",
-			"level 0\n> \n> level 1\n> \n>> level 2\n> \n> level 1\n\nlevel 0",
+			"level 0\n\n> level 1\n>> level 2\n> level 1\n\nlevel 0",
 		},
 		{
 			"<blockquote>Test</blockquote>Test",
-			"> \n> Test\n\nTest",
+			"> Test\n\nTest",
 		},
 		{
 			"\t<blockquote> \nTest<br></blockquote> ",
-			"> \n> Test\n>",
+			"> Test",
 		},
 		{
 			"\t<blockquote> \nTest line 1<br>Test 2</blockquote> ",
-			"> \n> Test line 1\n> Test 2",
+			"> Test line 1\n> Test 2",
+		},
+		{
+			"<blockquote>1<blockquote>2<blockquote>3</blockquote>2</blockquote>1</blockquote>",
+			"> 1\n>> 2\n>>> 3\n>> 2\n> 1",
 		},
 		{
 			"<blockquote>Test</blockquote> <blockquote>Test</blockquote> Other Test",
-			"> \n> Test\n\n> \n> Test\n\nOther Test",
+			"> Test\n\n> Test\n\nOther Test",
 		},
 		{
 			"<blockquote>Lorem ipsum Commodo id consectetur pariatur ea occaecat minim aliqua ad sit consequat quis ex commodo Duis incididunt eu mollit consectetur fugiat voluptate dolore in pariatur in commodo occaecat Ut occaecat velit esse labore aute quis commodo non sit dolore officia Excepteur cillum amet cupidatat culpa velit labore ullamco dolore mollit elit in aliqua dolor irure do</blockquote>",
-			"> \n> Lorem ipsum Commodo id consectetur pariatur ea occaecat minim aliqua ad\n> sit consequat quis ex commodo Duis incididunt eu mollit consectetur fugiat\n> voluptate dolore in pariatur in commodo occaecat Ut occaecat velit esse\n> labore aute quis commodo non sit dolore officia Excepteur cillum amet\n> cupidatat culpa velit labore ullamco dolore mollit elit in aliqua dolor\n> irure do",
+			"> Lorem ipsum Commodo id consectetur pariatur ea occaecat minim aliqua ad\n> sit consequat quis ex commodo Duis incididunt eu mollit consectetur fugiat\n> voluptate dolore in pariatur in commodo occaecat Ut occaecat velit esse\n> labore aute quis commodo non sit dolore officia Excepteur cillum amet\n> cupidatat culpa velit labore ullamco dolore mollit elit in aliqua dolor\n> irure do",
 		},
 		{
 			"<blockquote>Lorem<b>ipsum</b><b>Commodo</b><b>id</b><b>consectetur</b><b>pariatur</b><b>ea</b><b>occaecat</b><b>minim</b><b>aliqua</b><b>ad</b><b>sit</b><b>consequat</b><b>quis</b><b>ex</b><b>commodo</b><b>Duis</b><b>incididunt</b><b>eu</b><b>mollit</b><b>consectetur</b><b>fugiat</b><b>voluptate</b><b>dolore</b><b>in</b><b>pariatur</b><b>in</b><b>commodo</b><b>occaecat</b><b>Ut</b><b>occaecat</b><b>velit</b><b>esse</b><b>labore</b><b>aute</b><b>quis</b><b>commodo</b><b>non</b><b>sit</b><b>dolore</b><b>officia</b><b>Excepteur</b><b>cillum</b><b>amet</b><b>cupidatat</b><b>culpa</b><b>velit</b><b>labore</b><b>ullamco</b><b>dolore</b><b>mollit</b><b>elit</b><b>in</b><b>aliqua</b><b>dolor</b><b>irure</b><b>do</b></blockquote>",
-			"> \n> Lorem *ipsum* *Commodo* *id* *consectetur* *pariatur* *ea* *occaecat* *minim*\n> *aliqua* *ad* *sit* *consequat* *quis* *ex* *commodo* *Duis* *incididunt* *eu*\n> *mollit* *consectetur* *fugiat* *voluptate* *dolore* *in* *pariatur* *in* *commodo*\n> *occaecat* *Ut* *occaecat* *velit* *esse* *labore* *aute* *quis* *commodo*\n> *non* *sit* *dolore* *officia* *Excepteur* *cillum* *amet* *cupidatat* *culpa*\n> *velit* *labore* *ullamco* *dolore* *mollit* *elit* *in* *aliqua* *dolor* *irure*\n> *do*",
+			"> Lorem *ipsum* *Commodo* *id* *consectetur* *pariatur* *ea* *occaecat* *minim*\n> *aliqua* *ad* *sit* *consequat* *quis* *ex* *commodo* *Duis* *incididunt* *eu*\n> *mollit* *consectetur* *fugiat* *voluptate* *dolore* *in* *pariatur* *in* *commodo*\n> *occaecat* *Ut* *occaecat* *velit* *esse* *labore* *aute* *quis* *commodo*\n> *non* *sit* *dolore* *officia* *Excepteur* *cillum* *amet* *cupidatat* *culpa*\n> *velit* *labore* *ullamco* *dolore* *mollit* *elit* *in* *aliqua* *dolor* *irure*\n> *do*",
+		},
+		{
+			"<blockquote>Quote<blockquote>Lorem ipsum Commodo id consectetur pariatur ea occaecat minim aliqua ad sit consequat quis ex commodo</blockquote></blockquote>",
+			"> Quote\n>> Lorem ipsum Commodo id consectetur pariatur ea occaecat minim aliqua ad\n>> sit consequat quis ex commodo",
 		},
 	}
 
 	for _, testCase := range testCases {
-		if msg, err := wantString(testCase.input, testCase.output); err != nil {
+		if msg, err := wantString(testCase.input, testCase.output, Options{BoldMarker: "*"}); err != nil {
 			t.Error(err)
 		} else if len(msg) > 0 {
 			t.Log(msg)
 		}
 	}
 
+	//a quoted paragraph of just a link goes in a link line whole, not broken to fit the quote
+	input := "<blockquote><p><a href=\"/x\">Lorem ipsum Commodo id consectetur pariatur ea occaecat minim aliqua ad sit consequat quis ex commodo</a></p></blockquote>"
+	if msg, err := wantString(input, "> => /x Lorem ipsum Commodo id consectetur pariatur ea occaecat minim aliqua ad sit consequat quis ex commodo", Options{ListItemToLinkWordThreshold: 20}); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
 }
 
 func TestIgnoreStylesScriptsHead(t *testing.T) {
@@ -882,6 +968,3465 @@ func TestPeriod(t *testing.T) {
 	}
 }
 
+func TestOrderedLists(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"<ol><li>item 1</li><li>item 2</li><li>item 3</li></ol>",
+			"1. item 1\n2. item 2\n3. item 3",
+		},
+		{
+			"<ol start=\"5\"><li>item 5</li><li>item 6</li></ol>",
+			"5. item 5\n6. item 6",
+		},
+		{
+			"<ol><li>a</li><li>b</li></ol><ol><li>c</li></ol>",
+			"1. a\n2. b\n\n1. c",
+		},
+		{
+			"<ol><li>a</li><li>b<ol><li>x</li><li>y</li></ol></li><li>c</li></ol>",
+			"1. a\n2. b\n1. x\n2. y\n3. c",
+		},
+		{
+			`<ol reversed start="3"><li>c</li><li>b</li><li>a</li></ol>`,
+			"3. c\n2. b\n1. a",
+		},
+		{
+			"<ol reversed><li>c</li><li>b</li><li>a</li></ol>",
+			"3. c\n2. b\n1. a",
+		},
+		{
+			`<ol reversed start="10"><li>j</li><li>i</li></ol>`,
+			"10. j\n9. i",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+
+	options := *NewOptions()
+	if msg, err := wantString(`<ol start="3"><li><a href="http://example.com/">Example</a></li></ol>`, "=> http://example.com/ 3. Example", options); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+}
+
+func TestEmphasis(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"<em>Test</em>",
+			"*Test*",
+		},
+		{
+			"<i>Test</i> <em>Test</em>",
+			"*Test* *Test*",
+		},
+		{
+			"\t<em>Test line 1<br>Test 2</em> ",
+			"*Test line 1\nTest 2*",
+		},
+		{
+			"<p>Some <em>emphasised</em> text.</p>",
+			"Some *emphasised* text.",
+		},
+		{
+			"Empty<em></em> emphasis",
+			"Empty emphasis",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, Options{EmphasisMarker: "*"}); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+
+	if msg, err := wantString("<em>Test</em>", "_Test_", Options{EmphasisMarker: "_"}); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+}
+
+func TestInlineCode(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"Call <code>foo()</code> now.",
+			"Call `foo()` now.",
+		},
+		{
+			"<p>Spacing <code>a  =  b</code> is kept.</p>",
+			"Spacing `a  =  b` is kept.",
+		},
+		{
+			"<code>a\nb</code>",
+			"`a b`",
+		},
+		{
+			"<pre><code>x = 1</code></pre>",
+			"```\nx = 1\n```",
+		},
+		{
+			"Empty<code></code> code",
+			"Empty code",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, Options{InlineCodeMarker: "`"}); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestHorizontalRules(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"<p>Test text</p><hr><p>Test text</p>",
+			"Test text\n\n---\n\nTest text",
+		},
+		{
+			"Test text<hr/>Test text",
+			"Test text\n\n---\n\nTest text",
+		},
+		{
+			"<p>Test text</p>\n\n<hr>\n\n<hr>\n\n<p>Test text</p>",
+			"Test text\n\n---\n\n---\n\nTest text",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, Options{HorizontalRuleText: "---"}); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+
+	if msg, err := wantString("Test text<hr>Test text", "Test text Test text"); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+}
+
+func TestDefinitionLists(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"<dl><dt>Term</dt><dd>Definition</dd></dl>",
+			"*Term*\n  Definition",
+		},
+		{
+			"<p>Glossary</p><dl><dt>Gemini</dt><dd>A protocol.</dd><dt>Gemtext</dt><dd>A format.</dd></dl><p>After</p>",
+			"Glossary\n\n*Gemini*\n  A protocol.\n*Gemtext*\n  A format.\n\nAfter",
+		},
+		{
+			"<dl><dt>Term</dt><dd>Definition<dl><dt>Inner</dt><dd>Nested</dd></dl></dd></dl>",
+			"*Term*\n  Definition\n\n  *Inner*\n    Nested",
+		},
+		{
+			"<dl><dt>Term</dt><dd><dl><dt>Inner</dt><dd>Nested</dd></dl></dd></dl>",
+			"*Term*\n\n  *Inner*\n    Nested",
+		},
+		{
+			"<dl><dt>Term</dt><dd><ul><li>item</li></ul></dd></dl>",
+			"*Term*\n\n* item",
+		},
+		{
+			"<dl><dt>Term</dt><dd><p>See <a href=\"/a\">a</a> and <a href=\"/b\">b</a></p></dd></dl>",
+			"*Term*\n\nSee a and b\n\n=> /a a\n=> /b b",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, Options{EmphasisMarker: "*", DefinitionIndent: "  "}); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestNestedLists(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"<ul><li>item 1<ul><li>item 1.1</li><li>item 1.2</li></ul></li><li>item 2</li></ul>_",
+			"* item 1\n  * item 1.1\n  * item 1.2\n* item 2\n\n_",
+		},
+		{
+			"<ol><li>item 1<ul><li>item 1.1</li></ul></li><li>item 2<ol><li>item 2.1</li></ol></li></ol>",
+			"1. item 1\n  * item 1.1\n2. item 2\n  1. item 2.1",
+		},
+		{
+			"<ul><li>item 1<ul><li>see <a href=\"http://example.com/\">example</a> too</li></ul></li></ul>",
+			"* item 1\n  * see example too\n\n=> http://example.com/ example",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, Options{ListIndent: "  "}); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+
+	//a nested item of just a link keeps its bullet, as a link line would lose the indent
+	singleLinkCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			`<ul><li>item 1<ul><li><a href="http://example.com/">example</a></li></ul></li></ul>`,
+			"* item 1\n  * example\n\n=> http://example.com/ example",
+		},
+		{
+			`<ul><li>a<ul><li><a href="/x">X</a></li></ul></li></ul>`,
+			"* a\n  * X\n\n=> /x X",
+		},
+		{
+			`<ul><li><a href="/x">X</a></li></ul>`,
+			"=> /x X",
+		},
+	}
+
+	for _, testCase := range singleLinkCases {
+		options := Options{ListIndent: "  ", ListItemToLinkWordThreshold: 30}
+		if msg, err := wantString(testCase.input, testCase.output, options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	testCases := []struct {
+		input string
+		expr  string
+	}{
+		{
+			`<a href="/bar/baz">Bar</a>`,
+			`=> https://example\.com/bar/baz +Bar$`,
+		},
+		{
+			`<a href="../page.html">Page</a>`,
+			`=> https://example\.com/page\.html +Page$`,
+		},
+		{
+			`<a href="//other.example.com/path">Other</a>`,
+			`=> https://other\.example\.com/path +Other$`,
+		},
+		{
+			`<a href="gemini://example.org/">Capsule</a>`,
+			`=> gemini://example\.org/ +Capsule$`,
+		},
+		{
+			`<html><head><base href="https://example.org/root/"></head><body><a href="page.html">Page</a></body></html>`,
+			`=> https://example\.org/root/page\.html +Page$`,
+		},
+		{
+			`<html><head><base href="/root/"></head><body><a href="page.html">Page</a></body></html>`,
+			`=> https://example\.com/root/page\.html +Page$`,
+		},
+		{
+			`<a href="#usage">Usage</a>`,
+			`=> https://example\.com/dir/index\.html#usage +Usage$`,
+		},
+		{
+			`<html><head><base href="https://example.org/root/"></head><body><a href="#usage">Usage</a></body></html>`,
+			`=> https://example\.org/root/#usage +Usage$`,
+		},
+		{
+			`<a href="https://例え.jp/ページ">IDN</a>`,
+			`=> https://xn--r8jz45g\.jp/%E3%83%9A%E3%83%BC%E3%82%B8 +IDN$`,
+		},
+		{
+			`<html><head><base href="http://Bücher.example:8080/"></head><body><a href="café">Café</a></body></html>`,
+			`=> http://xn--bcher-kva\.example:8080/caf%C3%A9 +Café$`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantRegExp(testCase.input, testCase.expr, Options{BaseURL: "https://example.com/dir/index.html"}); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+
+	if msg, err := wantRegExp(`<a href="/bar/baz">Bar</a>`, `=> /bar/baz +Bar$`); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+}
+
+type countingWriter struct {
+	buf    bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.buf.Write(p)
+}
+
+func TestFromReaderToWriter(t *testing.T) {
+	var input strings.Builder
+	input.WriteString("<h1>Title</h1>")
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&input, `<p>Paragraph %d with a <a href="http://example.com/%d">link</a>.</p>`, i, i)
+		fmt.Fprintf(&input, `<blockquote>Quote %d<br>second line</blockquote>`, i)
+		fmt.Fprintf(&input, `<ul><li>item %d</li><li>item %d</li></ul><div>Division %d</div>`, i, i+1, i)
+	}
+
+	for _, options := range []Options{{}, *NewOptions(), {WrapWidth: 20}} {
+		ctx := NewTraverseContext(options)
+		want, err := FromString(input.String(), *ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := &countingWriter{}
+		ctx = NewTraverseContext(options)
+		if err := FromReaderToWriter(strings.NewReader(input.String()), w, *ctx); err != nil {
+			t.Fatal(err)
+		}
+		if got := w.buf.String(); got != want {
+			t.Errorf("streamed output differs from FromString output:\n%v\n\nwant:\n%v", got, want)
+		}
+		if w.writes < 2 {
+			t.Errorf("expected output to be streamed in several writes, got %d", w.writes)
+		}
+	}
+}
+
+func TestLinksFromHTMLNode(t *testing.T) {
+	input := `<p>See <a href="http://example.com/1">one</a> and <img src="http://example.com/2.png" alt="two"> here.</p>
+<ul><li><a href="http://example.com/3">three</a></li></ul>`
+
+	doc, err := html.Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := *NewOptions()
+	links, text, err := LinksFromHTMLNode(doc, *NewTraverseContext(options))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Link{
+		{Index: 1, URL: "http://example.com/1", Display: "one"},
+		{Index: 2, URL: "http://example.com/2.png", Display: "[‡ two]", Media: true},
+		{Index: 0, URL: "http://example.com/3", Display: "three"},
+	}
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("got links %#v, want %#v", links, want)
+	}
+
+	wantText, err := FromString(input, *NewTraverseContext(options))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != wantText {
+		t.Errorf("got text %q, want %q", text, wantText)
+	}
+}
+
+func TestDeduplicateLinks(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			`<a href="http://example1.com/">Link1</a> <a href="http://example2.com/">Link2</a> <a href="http://example1.com/">Link3</a>`,
+			"Link1 [1] Link2 [2] Link3 [1]\n\n=> http://example1.com/ [1] Link1\n=> http://example2.com/ [2] Link2",
+		},
+		{
+			`<a href="http://example.com/a b">One</a> <a href="http://example.com/a%20b">Two</a> <a href="http://example.com/A%20b">Three</a>`,
+			"One [1] Two [1] Three [2]\n\n=> http://example.com/a%20b [1] One\n=> http://example.com/A%20b [2] Three",
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := Options{DeduplicateLinks: true, CitationMarkers: true, NumberedLinks: true, LinkEmitFrequency: 100}
+		if msg, err := wantString(testCase.input, testCase.output, options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestLinkRewriter(t *testing.T) {
+	rewriter := func(link string) string {
+		if strings.HasPrefix(link, "http://drop.example.com/") {
+			return ""
+		}
+		return "gemini://portal.example.org/proxy/" + link
+	}
+
+	testCases := []struct {
+		input string
+		expr  string
+	}{
+		{
+			`<a href="http://example.com/">Link</a>`,
+			`^Link\n\n=> gemini://portal\.example\.org/proxy/http://example\.com/ +Link$`,
+		},
+		{
+			`<img src="http://example.com/image.png" alt="Image">`,
+			`^\[ Image\]\n\n=> gemini://portal\.example\.org/proxy/http://example\.com/image\.png +\[ Image\]$`,
+		},
+		{
+			`<a href="http://drop.example.com/page">Dropped</a>`,
+			`^Dropped$`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantRegExp(testCase.input, testCase.expr, Options{LinkRewriter: rewriter, EmitImagesAsLinks: true}); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestScriptAndDataURIs(t *testing.T) {
+	dataURI := "data:image/png;base64," + strings.Repeat("iVBORw0KGgo", 100)
+
+	testCases := []struct {
+		input            string
+		maxDataURILength int
+		expr             string
+	}{
+		{
+			`<a href="javascript:void(0)">Click</a>`,
+			0,
+			`^Click$`,
+		},
+		{
+			`<a href="JavaScript:alert('hi')">Click</a>`,
+			-1,
+			`^Click$`,
+		},
+		{
+			`<a href="` + dataURI + `">Data</a>`,
+			0,
+			`^Data$`,
+		},
+		{
+			`<a href="` + dataURI + `">Data</a>`,
+			2000,
+			`^Data\n\n=> data:image/png;base64,(iVBORw0KGgo)+ +Data$`,
+		},
+		{
+			`<a href="` + dataURI + `">Data</a>`,
+			-1,
+			`^Data\n\n=> data:image/png;base64,(iVBORw0KGgo)+ +Data$`,
+		},
+		{
+			`<a href="data:text/plain,hi">Data</a>`,
+			100,
+			`^Data\n\n=> data:text/plain,hi +Data$`,
+		},
+		{
+			`<a href="data:text/plain,hi">Data</a>`,
+			0,
+			`^Data\n\n=> data:text/plain,hi +Data$`,
+		},
+		{
+			`<img src="` + dataURI + `">`,
+			0,
+			`^\[ \]$`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := Options{MaxDataURILength: testCase.maxDataURILength, EmitImagesAsLinks: true}
+		if msg, err := wantRegExp(testCase.input, testCase.expr, options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestBulletMarker(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"<ul><li>item 1</li><li>item 2</li></ul>",
+			"- item 1\n- item 2",
+		},
+		{
+			"<ul><li>item 1<ul><li>item 1.1</li></ul></li></ul>",
+			"- item 1\n- item 1.1",
+		},
+		{
+			"<ul><li>see <a href=\"http://example.com/\">example</a> too</li></ul>",
+			"- see example too\n\n=> http://example.com/ example",
+		},
+		{
+			"<ol><li>item 1</li></ol>",
+			"1. item 1",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, Options{BulletMarker: "- "}); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+
+	options := Options{BulletMarker: "• ", ListItemToLinkWordThreshold: 30}
+	if msg, err := wantString(`<ul><li><a href="http://example.com/">example</a></li><li>plain</li></ul>`, "=> http://example.com/ example\n• plain", options); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+}
+
+func TestHeadingPrefixes(t *testing.T) {
+	testCases := []struct {
+		input    string
+		prefixes []string
+		output   string
+	}{
+		{
+			"<h1>One</h1><h2>Two</h2><h3>Three</h3>",
+			nil,
+			"# One\n\n## Two\n\n### Three",
+		},
+		{
+			"<h1>One</h1><h2>Two</h2><h3>Three</h3>",
+			[]string{"#", "##", "###"},
+			"# One\n\n## Two\n\n### Three",
+		},
+		{
+			"Text<h1>One</h1>Text",
+			[]string{""},
+			"Text\n\nOne\n\nText",
+		},
+		{
+			"<h1>One</h1><h3>Three</h3>",
+			[]string{"#= "},
+			"#= One\n\n### Three",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, Options{HeadingPrefixes: testCase.prefixes}); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestFromBytes(t *testing.T) {
+	bs, err := ioutil.ReadFile(path.Join(destPath, "utf8_with_bom.xhtml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	text, err := FromBytes(bs, *NewTraverseContext(Options{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := FromReader(bytes.NewReader(bs), *NewTraverseContext(Options{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != want {
+		t.Errorf("FromBytes output differs from FromReader output:\n%v\n\nwant:\n%v", text, want)
+	}
+	if !strings.Contains(text, "种新的波兰文本已成为必要") {
+		t.Errorf("expected keyword in output:\n%v", text)
+	}
+
+	//the bytes are parsed where they are, rather than read into a copy
+	fromBytes := testing.AllocsPerRun(10, func() {
+		FromBytes(bs, *NewTraverseContext(Options{}))
+	})
+	fromReader := testing.AllocsPerRun(10, func() {
+		FromReader(bytes.NewReader(bs), *NewTraverseContext(Options{}))
+	})
+	if fromBytes >= fromReader {
+		t.Errorf("got %v allocations from FromBytes, want fewer than the %v from FromReader", fromBytes, fromReader)
+	}
+}
+
+func TestReset(t *testing.T) {
+	input := `<blockquote><p>Quote with <a href="/a">a link</a> and <a href="/b">another</a></p></blockquote><ol><li>item`
+	doc, err := html.Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := *NewOptions()
+	options.BaseURL = "http://example.com/"
+	want, err := FromString(input, *NewTraverseContext(options))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := NewTraverseContext(options)
+	for i := 0; i < 3; i++ {
+		got, err := ctx.Render(doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got %q from render %d, want %q", got, i+1, want)
+		}
+		if links := ctx.Links(); len(links) != 2 || links[0].Index != 1 {
+			t.Errorf("got links %+v from render %d, want the two citations from the first", links, i+1)
+		}
+		ctx.Reset()
+		if links := ctx.Links(); len(links) != 0 {
+			t.Errorf("got links %+v after Reset, want none", links)
+		}
+	}
+
+	//without a Reset, the citations of the next document number on from those of the last
+	if _, err := ctx.Render(doc); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ctx.Render(doc); err != nil {
+		t.Fatal(err)
+	} else if got == want {
+		t.Errorf("got %q rendering twice without a Reset, want the citations numbered on", got)
+	}
+}
+
+func TestWrapWidth(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"<p>Lorem ipsum Commodo id consectetur pariatur ea occaecat minim aliqua ad sit consequat quis</p>",
+			"Lorem ipsum Commodo id\nconsectetur pariatur ea\noccaecat minim aliqua ad sit\nconsequat quis",
+		},
+		{
+			"<blockquote>Quote<br>Lorem ipsum Commodo id consectetur pariatur ea occaecat minim</blockquote>",
+			"> Quote\n> Lorem ipsum Commodo id\n> consectetur pariatur ea\n> occaecat minim",
+		},
+		{
+			"<p>Short line</p><pre>a long preformatted line which must not be wrapped</pre>",
+			"Short line\n\n```\na long preformatted line which must not be wrapped\n```",
+		},
+		{
+			"<h1>A long heading which must not be wrapped</h1>",
+			"# A long heading which must not be wrapped",
+		},
+		{
+			"<p><a href=\"http://example.com/a/long/url/which/must/not/be/wrapped\">Link</a> with some text after it</p>",
+			"Link with some text after it\n\n=> http://example.com/a/long/url/which/must/not/be/wrapped Link",
+		},
+		{
+			"<p>Averyveryverylongwordwhichcannotbewrapped at all</p>",
+			"Averyveryverylongwordwhichcannotbewrapped\nat all",
+		},
+		{
+			"<p>aaaa bbbb cccc dddd eeee ffff => not a link here</p>",
+			"aaaa bbbb cccc dddd eeee ffff =>\nnot a link here",
+		},
+		{
+			"<p>aaaa bbbb cccc dddd eeee ffff #1 ``` * > then text</p>",
+			"aaaa bbbb cccc dddd eeee ffff #1 ``` * >\nthen text",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, Options{WrapWidth: 30}); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestStrong(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"<strong>Test</strong>",
+			"*Test*",
+		},
+		{
+			"\t<strong>Test line 1<br>Test 2</strong> ",
+			"*Test line 1\nTest 2*",
+		},
+		{
+			"<strong>Test</strong> <b>Test</b>",
+			"*Test* *Test*",
+		},
+		{
+			"<strong><em>Test</em></strong>",
+			"*_Test_*",
+		},
+		{
+			"<strong>Bold <em>and emphasised</em> text</strong>.",
+			"*Bold _and emphasised_ text*.",
+		},
+		{
+			"Empty<strong></strong> strong",
+			"Empty strong",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, Options{EmphasisMarker: "_", BoldMarker: "*"}); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+
+	if msg, err := wantString("<strong>Test</strong>", "**Test**", Options{BoldMarker: "**"}); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+}
+
+func TestStrikethrough(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"<del>Test</del>",
+			"~~Test~~",
+		},
+		{
+			"Price: <s>$10</s> $5",
+			"Price: ~~$10~~ $5",
+		},
+		{
+			"<strike>Old</strike> new",
+			"~~Old~~ new",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, Options{StrikethroughMarker: "~~"}); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+
+	if msg, err := wantString("Price: <del>$10</del> $5", "Price: $10 $5"); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+}
+
+func TestSuperscriptAndSubscript(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"H<sub>2</sub>O",
+			"H₂O",
+		},
+		{
+			"E = mc<sup>2</sup>",
+			"E = mc²",
+		},
+		{
+			"x<sup>n+1</sup> and x<sub>i</sub>.",
+			"xⁿ⁺¹ and xᵢ.",
+		},
+		{
+			"the 21<sup>st</sup> century",
+			"the 21ˢᵗ century",
+		},
+		{
+			"x<sup>q</sup> y<sub>QR</sub>",
+			"x^q y_(QR)",
+		},
+		{
+			"Text<sup><a href=\"http://example.com/\">[1]</a></sup>",
+			"Text [1]\n\n=> http://example.com/ [1]",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, Options{SuperscriptFallback: "^", SubscriptFallback: "_"}); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+
+	if msg, err := wantString("x<sup>q</sup>", "xq"); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+}
+
+func TestTableCaptions(t *testing.T) {
+	input := "<table><caption>Results</caption><tr><td>a</td><td>b</td></tr></table>"
+	grid := `\+[-+]+\+\n(?:\|.*\|\n)+\+[-+]+\+\n`
+
+	testCases := []struct {
+		below   bool
+		inFence bool
+		output  string
+	}{
+		{false, false, "^Results\n```\n" + grid + "```$"},
+		{false, true, "^```\nResults\n" + grid + "```$"},
+		{true, false, "^```\n" + grid + "```\nResults$"},
+		{true, true, "^```\n" + grid + "Results\n```$"},
+	}
+
+	for _, testCase := range testCases {
+		options := Options{
+			PrettyTables:        true,
+			PrettyTablesOptions: NewPrettyTablesOptions(),
+			TableCaptionBelow:   testCase.below,
+			TableCaptionInFence: testCase.inFence,
+		}
+		if msg, err := wantRegExp(input, testCase.output, options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+
+	if msg, err := wantString(input, "⊞ table ⊞\n\nResults\n\na b"); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+}
+
+func TestTableSpans(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			`<table><tr><td colspan="2">wide</td></tr><tr><td>a</td><td>b</td></tr></table>`,
+			`\| [^|\n]*wide[^|\n]* \| [^|\n]* \|\n(?:\|.*\|\n)*\| [^|\n]*a[^|\n]* \| [^|\n]*b[^|\n]* \|`,
+		},
+		{
+			`<table><tr><td rowspan="2">tall</td><td>a</td></tr><tr><td>b</td></tr></table>`,
+			`\| [^|\n]*tall[^|\n]* \| [^|\n]*a[^|\n]* \|\n(?:\|.*\|\n)*\| +\| [^|\n]*b[^|\n]* \|`,
+		},
+		{
+			`<table><tr><td>a</td></tr><tr><td>b</td><td>c</td><td>d</td></tr></table>`,
+			`\| [^|\n]*a[^|\n]* \| +\| +\|\n(?:\|.*\|\n)*\| [^|\n]*b[^|\n]* \| [^|\n]*c[^|\n]* \| [^|\n]*d[^|\n]* \|`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := Options{PrettyTables: true, PrettyTablesOptions: NewPrettyTablesOptions()}
+		if msg, err := wantRegExp(testCase.input, testCase.output, options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestMarkdownTables(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"<table><tr><th>Name</th><th>Size</th></tr><tr><td>a</td><td>1</td></tr><tr><td>b|c</td><td>2</td></tr></table>",
+			"| Name | Size |\n|---|---|\n| a | 1 |\n| b\\|c | 2 |",
+		},
+		{
+			"<table><tr><td>a</td><td>b</td></tr><tr><td colspan=2>c</td></tr></table>",
+			"| a | b |\n|---|---|\n| c |  |",
+		},
+		{
+			"<p>Before</p><table><caption>Sizes</caption><tr><td>a</td></tr></table><p>After</p>",
+			"Before\n\nSizes\n| a |\n|---|\n\nAfter",
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := Options{PrettyTables: true, TableStyle: TableStyleMarkdown}
+		if msg, err := wantString(testCase.input, testCase.output, options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+
+	//the rows stay whole when the text around is wrapped
+	options := Options{PrettyTables: true, TableStyle: TableStyleMarkdown, WrapWidth: 20}
+	input := "<p>Some text which is long enough to wrap</p><table><tr><th>Name</th><th>Description</th></tr>" +
+		"<tr><td>alpha</td><td>the first letter of the alphabet</td></tr></table>"
+	output := "Some text which is\nlong enough to wrap\n\n| Name | Description |\n|---|---|\n| alpha | the first letter of the alphabet |"
+	if msg, err := wantString(input, output, options); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+}
+
+func TestPreLanguage(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"<pre><code class=\"language-go\">x := 1</code></pre>",
+			"```go\nx := 1\n```",
+		},
+		{
+			"<pre class=\"highlight lang-python\">print(1)</pre>",
+			"```python\nprint(1)\n```",
+		},
+		{
+			"<pre>\n  <code class=\"hljs language-rust\">let x = 1;</code></pre>",
+			"```rust\n  let x = 1;\n```",
+		},
+		{
+			"<pre><code>plain</code></pre>",
+			"```\nplain\n```",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestFigures(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"<figure><img src=x alt=Y><figcaption>A caption</figcaption></figure>",
+			"[‡ Y] [1]\nA caption\n\n=> x [1] [‡ Y]",
+		},
+		{
+			"Intro <figure><figcaption>Top</figcaption><img src=x alt=Y></figure> after",
+			"Intro\n\nTop\n[‡ Y] [1]\n\nafter\n\n=> x [1] [‡ Y]",
+		},
+		{
+			"<p>before</p><figure><blockquote><p>Quoted text.</p><p>More text.</p></blockquote><figcaption>— Author, <cite>Book</cite></figcaption></figure><p>after</p>",
+			"before\n\n> Quoted text.\n> More text.\n> — Author, Book\n\nafter",
+		},
+		{
+			"<figure>\n<blockquote>Quoted</blockquote>\n<figcaption>Author</figcaption>\n</figure>",
+			"> Quoted\n> — Author",
+		},
+		{
+			"<blockquote>Outer<figure><blockquote>Inner</blockquote><figcaption>Author</figcaption></figure></blockquote>",
+			"> Outer\n>> Inner\n>> — Author",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, *NewOptions()); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestMediaLinks(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			`<video controls title="The demo" src="/demo.mp4">Your browser cannot play video</video>`,
+			"[The demo] [1]\n\n=> /demo.mp4 [1] [The demo]",
+		},
+		{
+			`<audio><source src="a.ogg"><source src="a.mp3">No audio</audio>`,
+			"[audio] [1]\n\n=> a.ogg [1] [audio]",
+		},
+		{
+			`<video poster="img/cover-shot.jpg"><source src=v.webm></video>`,
+			"[cover-shot] [1]\n\n=> v.webm [1] [cover-shot]",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, *NewOptions()); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+
+	if msg, err := wantString("<video src=x.mp4>Fallback text</video>", "Fallback text"); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+}
+
+func TestDetails(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"<details><summary>Why?</summary><p>Because.</p></details>",
+			"▸ Why?\nBecause.",
+		},
+		{
+			"<details><summary>Why?</summary>Because.<details><summary>Really?</summary>Yes.</details></details><p>Done</p>",
+			"▸ Why?\nBecause.\n\n▸ Really?\nYes.\n\nDone",
+		},
+		{
+			"Before<summary>Stray</summary>After",
+			"Before\n\nStray\n\nAfter",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, *NewOptions()); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+
+	if msg, err := wantString("<details><summary>Why?</summary>Because.</details>", "Why?\nBecause."); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+}
+
+func TestDialogs(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"<p>Before</p><dialog open><p>Saved.</p></dialog><p>After</p>",
+			"Before\n\nSaved.\n\nAfter",
+		},
+		{
+			"Before<dialog>Notice</dialog>After",
+			"Before\n\nNotice\n\nAfter",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+
+	options := NewOptions()
+	options.SkipClosedDialogs = true
+	if msg, err := wantString("Before<dialog open>Open</dialog><dialog>Closed</dialog>After", "Before\n\nOpen\n\nAfter", *options); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+}
+
+func TestHiddenElements(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			`<p>Shown</p><p hidden>Hidden</p><div hidden="">Also hidden</div>`,
+			"Shown",
+		},
+		{
+			`<p>Shown <span hidden="until-found">found</span></p>`,
+			"Shown found",
+		},
+		{
+			`<p>Shown <span style="display: none">gone</span><span style="color:red; VISIBILITY:hidden !important">gone</span></p>`,
+			"Shown",
+		},
+		{
+			`<p>Shown <span style="display:none-ish">kept</span><span style="visibility: visible">kept</span></p>`,
+			"Shown kept kept",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, Options{RespectInlineDisplayNone: true}); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+
+	if msg, err := wantString(`<p>Shown <span style="display:none">styled</span></p>`, "Shown styled"); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+}
+
+func TestNavAndFooter(t *testing.T) {
+	input := "<nav>Home About</nav><p>Body text</p><footer>Copyright</footer>"
+	testCases := []struct {
+		options Options
+		output  string
+	}{
+		{Options{}, "Body text"},
+		{Options{IncludeNav: true}, "Home About\n\nBody text"},
+		{Options{IncludeFooter: true}, "Body text\n\nCopyright"},
+		{Options{IncludeNav: true, IncludeFooter: true}, "Home About\n\nBody text\n\nCopyright"},
+		{Options{NavFooterPlacement: NavFooterInline}, "Home About\n\nBody text\n\nCopyright"},
+		{Options{NavFooterPlacement: NavFooterAppendix}, "Body text\n\nHome About\n\nCopyright"},
+		{Options{NavFooterPlacement: NavFooterAppendix, NavigationHeading: "Navigation", FooterHeading: "Footer"},
+			"Body text\n\n## Navigation\n\nHome About\n\n## Footer\n\nCopyright"},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(input, testCase.output, testCase.options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestSkipElements(t *testing.T) {
+	input := `<p>Body text</p>
+		<aside>Related</aside>
+		<div class="banner cookie-banner">Accept cookies</div>
+		<div id="share">Share this</div>
+		<my-widget>Widget</my-widget>`
+
+	testCases := []struct {
+		options Options
+		output  string
+	}{
+		{Options{SkipElements: []string{"ASIDE", "my-widget"}}, "Body text\nAccept cookies\nShare this"},
+		{Options{SkipClasses: []string{"cookie-banner"}}, "Body text\n\nRelated\n\nShare this\nWidget"},
+		{Options{SkipIDs: []string{"share"}, SkipClasses: []string{"cookie"}}, "Body text\n\nRelated\n\nAccept cookies\nWidget"},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(input, testCase.output, testCase.options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestRespectAria(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			`<p>Menu <span aria-hidden="true">☰</span> items</p>`,
+			"Menu items",
+		},
+		{
+			`<p>Logo <img src="/spacer.gif" alt="spacer" role="presentation"> here</p>`,
+			"Logo here",
+		},
+		{
+			`<p><span aria-hidden="false">shown</span></p>`,
+			"shown",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, *NewOptions()); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+
+	options := NewOptions()
+	options.RespectAria = false
+	if msg, err := wantString(`<p>Menu <span aria-hidden="true">☰</span> <img src="/spacer.gif" alt="spacer" role="presentation"></p>`, "=> /spacer.gif Menu ☰ [‡ spacer]", *options); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+}
+
+func TestElementHandlers(t *testing.T) {
+	options := Options{
+		ElementHandlers: map[atom.Atom]ElementHandler{
+			atom.Mark: func(ctx *TextifyTraverseContext, node *html.Node) (bool, error) {
+				if err := ctx.Emit("=="); err != nil {
+					return true, err
+				}
+				if err := ctx.EmitChildren(node); err != nil {
+					return true, err
+				}
+				return true, ctx.Emit("==")
+			},
+			atom.Span: func(ctx *TextifyTraverseContext, node *html.Node) (bool, error) {
+				if getAttrVal(node, "class") != "ref" {
+					return false, nil
+				}
+				return true, ctx.EmitLink(getAttrVal(node, "data-href"), node.FirstChild.Data)
+			},
+			0: func(ctx *TextifyTraverseContext, node *html.Node) (bool, error) {
+				return node.Data == "x-ad", nil
+			},
+		},
+	}
+
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"Some <mark>marked</mark> text",
+			"Some == marked == text",
+		},
+		{
+			`A <span class="ref" data-href="http://example.com/">ref</span> and <span>plain</span> text`,
+			"A and plain text\n\n=> http://example.com/ ref",
+		},
+		{
+			"Kept <x-note>note</x-note><x-ad>advert</x-ad>",
+			"Kept note",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestRenderedOnce(t *testing.T) {
+	//each item has links and a nested list, so none of them is rendered as a single line
+	const depth = 6
+	item := `Item with <em>some</em> text and <a href="/a">one</a> or <a href="/b">two</a> links`
+	input := "<p>" + item + "</p>" + strings.Repeat("<ul><li>"+item, depth) + strings.Repeat("</li></ul>", depth)
+
+	rendered := 0
+	options := NewOptions()
+	options.ElementHandlers = map[atom.Atom]ElementHandler{
+		atom.Em: func(ctx *TextifyTraverseContext, node *html.Node) (bool, error) {
+			rendered++
+			return false, nil
+		},
+	}
+	if _, err := FromString(input, *NewTraverseContext(*options)); err != nil {
+		t.Fatal(err)
+	}
+	if rendered != depth+1 {
+		t.Errorf("rendered %d elements %d times", depth+1, rendered)
+	}
+}
+
+func TestAbbreviations(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			`<p><abbr title="HyperText Markup Language">HTML</abbr> is parsed. <abbr title="HyperText Markup Language">HTML</abbr> is rendered.</p>`,
+			"HTML (HyperText Markup Language) is parsed. HTML is rendered.",
+		},
+		{
+			`<p><abbr>CSS</abbr> and <abbr title="Cascading Style Sheets">CSS</abbr>.</p><ul><li><abbr title="Cascading Style Sheets">CSS</abbr> again</li></ul>`,
+			"CSS and CSS (Cascading Style Sheets).\n\n* CSS again",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, Options{ExpandAbbreviations: true}); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+
+	if msg, err := wantString(`<abbr title="HyperText Markup Language">HTML</abbr>`, "HTML"); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+}
+
+func TestInlineQuotes(t *testing.T) {
+	testCases := []struct {
+		input   string
+		output  string
+		options Options
+	}{
+		{
+			"<p>She said <q>hello</q>.</p>",
+			"She said “hello”.",
+			Options{},
+		},
+		{
+			"<p><q>He said <q>hi <q>there</q></q> to me</q></p>",
+			"“He said ‘hi “there”’ to me”",
+			Options{},
+		},
+		{
+			"<p>She said <q>hello</q>.</p>",
+			`She said "hello".`,
+			Options{QuoteMarks: []string{`"`, `"`}},
+		},
+		{
+			`<p>As written, <q cite="http://example.com/speech">we shall</q>, and more.</p>`,
+			"As written, “we shall” [1], and more.\n\n=> http://example.com/speech [1] source",
+			Options{QuoteCiteLinks: true, CitationMarkers: true, NumberedLinks: true},
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, testCase.options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestCodeLikeSpans(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"<p>Press <kbd>Ctrl</kbd>+<kbd>C</kbd> to copy.</p>",
+			"Press `Ctrl`+`C` to copy.",
+		},
+		{
+			"<p>Press <kbd>Ctrl</kbd>+<kbd>C</kbd> now</p>",
+			"Press `Ctrl`+`C` now",
+		},
+		{
+			"<p>Press <kbd>Ctrl</kbd> + <kbd>C</kbd> now</p>",
+			"Press `Ctrl` + `C` now",
+		},
+		{
+			"<p>It prints <samp>Hello,  world</samp> for <var>name</var>.</p>",
+			"It prints `Hello,  world` for `name`.",
+		},
+		{
+			"<pre><kbd>ls -l</kbd></pre>",
+			"```\nls -l\n```",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, *NewOptions()); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestBlockquotePrefix(t *testing.T) {
+	input := "<blockquote>one<blockquote>two two two<blockquote>three</blockquote>two</blockquote>one</blockquote>"
+	testCases := []struct {
+		options Options
+		output  string
+	}{
+		{
+			Options{BlockquotePrefix: "> "},
+			"> one\n> > two two two\n> > > three\n> > two\n> one",
+		},
+		{
+			Options{BlockquotePrefix: "> ", WrapWidth: 11},
+			"> one\n> > two two\n> > two\n> > > three\n> > two\n> one",
+		},
+		{
+			Options{BlockquotePrefix: ">"},
+			"> one\n>> two two two\n>>> three\n>> two\n> one",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(input, testCase.output, testCase.options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestFragmentLinks(t *testing.T) {
+	input := `<p>See <a href="#usage">usage</a> and <a href="other.html#top">other</a>.</p>`
+	testCases := []struct {
+		options Options
+		output  string
+	}{
+		{
+			Options{},
+			"See usage and other.\n\n=> other.html#top other",
+		},
+		{
+			Options{KeepFragmentLinks: true},
+			"See usage and other.\n\n=> #usage usage\n=> other.html#top other",
+		},
+		{
+			Options{BaseURL: "gemini://example.org/doc/page.gmi"},
+			"See usage and other.\n\n=> gemini://example.org/doc/page.gmi#usage usage\n=> gemini://example.org/doc/other.html#top other",
+		},
+		{
+			Options{KeepFragmentLinks: true, BaseURL: "gemini://example.org/doc/page.gmi"},
+			"See usage and other.\n\n=> gemini://example.org/doc/page.gmi#usage usage\n=> gemini://example.org/doc/other.html#top other",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(input, testCase.output, testCase.options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+
+	ctx := NewTraverseContext(Options{})
+	if marker, cited := ctx.addCitation("", "empty", false); marker != "" || cited {
+		t.Errorf("expected no citation for an empty url, got %q", marker)
+	}
+}
+
+// TestRandomHTML renders random, often malformed, HTML to check that no input
+// makes the renderer panic.
+func TestRandomHTML(t *testing.T) {
+	tags := []string{"p", "div", "span", "a", "b", "i", "code", "pre", "br", "hr", "img", "h1", "h2", "h3",
+		"table", "caption", "thead", "tfoot", "tr", "th", "td", "ul", "ol", "li", "dl", "dt", "dd",
+		"blockquote", "sup", "sub", "q", "abbr", "figure", "figcaption", "details", "summary", "video", "source"}
+	attrs := []string{`href="#x"`, `href=""`, `href="javascript:x"`, `href="a b"`, `href="data:x"`, `src="x.png"`,
+		`alt=""`, `colspan="0"`, `colspan="3"`, `rowspan="9"`, `start="-3"`, `hidden`, `class="lang-go"`, `title="t"`, `cite="c"`}
+	texts := []string{"", " ", "\n", "\t\n ", "word", "two words", "é", " ", "​", "!", "(", "\xff", "日本"}
+
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		var sb strings.Builder
+		for n := r.Intn(60); n >= 0; n-- {
+			switch r.Intn(3) {
+			case 0:
+				sb.WriteString("<" + tags[r.Intn(len(tags))] + " " + attrs[r.Intn(len(attrs))] + ">")
+			case 1:
+				sb.WriteString("</" + tags[r.Intn(len(tags))] + ">")
+			default:
+				sb.WriteString(texts[r.Intn(len(texts))])
+			}
+		}
+		input := sb.String()
+
+		options := *NewOptions()
+		options.PrettyTables = r.Intn(2) == 0
+		options.WrapWidth = r.Intn(3) * 5
+		options.KeepFragmentLinks = r.Intn(2) == 0
+		if r.Intn(4) == 0 {
+			options = Options{}
+		}
+
+		func() {
+			defer func() {
+				if p := recover(); p != nil {
+					t.Errorf("panic rendering %q: %v", input, p)
+				}
+			}()
+			if _, err := FromString(input, *NewTraverseContext(options)); err != nil {
+				t.Errorf("error rendering %q: %v", input, err)
+			}
+		}()
+	}
+}
+
+func TestLinkWordThreshold(t *testing.T) {
+	options := Options{ListItemToLinkWordThreshold: 3}
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"<ul><li>two <a href=\"http://example.com/\">words</a></li></ul>",
+			"=> http://example.com/ two words",
+		},
+		{
+			"<ul><li>  three   <a href=\"http://example.com/\">short words</a>  </li></ul>",
+			"=> http://example.com/ three short words",
+		},
+		{
+			"<ul><li>now four <a href=\"http://example.com/\">short words</a></li></ul>",
+			"* now four short words\n\n=> http://example.com/ short words",
+		},
+		{
+			"<p>  three   <a href=\"http://example.com/\">short words</a>  </p>",
+			"=> http://example.com/ three short words",
+		},
+		{
+			"<p>now four <a href=\"http://example.com/\">short words</a></p>",
+			"now four short words\n\n=> http://example.com/ short words",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestTableCellContext(t *testing.T) {
+	input := `<p>See <a href="http://a/">A</a> and <a href="http://b/">B</a>.</p>` +
+		`<table><tr><td><a href="http://c/">C</a></td><td>  plain  text </td><td><a href="http://d/">D</a></td></tr></table>`
+	output := "See A [1] and B [2].\n\n```\n" +
+		"+-------+------------+-------+\n" +
+		"| C [3] | plain text | D [4] |\n" +
+		"+-------+------------+-------+\n" +
+		"```\n\n" +
+		"=> http://a/ [1] A\n=> http://b/ [2] B\n=> http://c/ [3] C\n=> http://d/ [4] D"
+
+	options := *NewOptions()
+	options.PrettyTables = true
+	if msg, err := wantString(input, output, options); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+}
+
+func TestTableCellLinks(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			`<table><tr><td>Go to <a href="http://example.com/">example</a></td></tr></table><p>After the table</p>`,
+			"```\n+-------------------+\n| Go to example [1] |\n+-------------------+\n```\n\n" +
+				"=> http://example.com/ [1] example\n\nAfter the table",
+		},
+		{
+			`<table><tr><th><a href="/a">A</a></th></tr><tr><td><a href="/b">B</a></td></tr></table>`,
+			"```\n+-------+\n| A [1] |\n+-------+\n| B [2] |\n+-------+\n```\n\n=> /a [1] A\n=> /b [2] B",
+		},
+	}
+
+	options := *NewOptions()
+	options.PrettyTables = true
+	options.PrettyTablesOptions.AutoFormatHeader = false
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+
+	doc, err := html.Parse(strings.NewReader(testCases[1].input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	links, _, err := LinksFromHTMLNode(doc, *NewTraverseContext(options))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Link{{Index: 1, URL: "/a", Display: "A"}, {Index: 2, URL: "/b", Display: "B"}}
+	if !reflect.DeepEqual(links, want) {
+		t.Errorf("got links %v, want %v", links, want)
+	}
+}
+
+func TestTableLineBreaks(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"<table><tr><td>line1<br>line2 is longer</td><td><span>inline</span> text</td></tr></table>",
+			// +-----------------+-------------+
+			// | line1           | inline text |
+			// | line2 is longer |             |
+			// +-----------------+-------------+
+			"```\n+-----------------+-------------+\n| line1           | inline text |\n| line2 is longer |             |\n+-----------------+-------------+\n```",
+		},
+		{
+			"<table><tr><td>short<br>a line long enough to be wrapped by the table</td></tr></table>",
+			// +--------------------------+
+			// | short                    |
+			// | a line long enough to be |
+			// | wrapped by the table     |
+			// +--------------------------+
+			"```\n+--------------------------+\n| short                    |\n| a line long enough to be |\n| wrapped by the table     |\n+--------------------------+\n```",
+		},
+	}
+
+	options := Options{PrettyTables: true, PrettyTablesOptions: NewPrettyTablesOptions()}
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestOrderedListTypes(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			`<ol type="a"><li>one</li><li>two</li><li>three</li></ol>`,
+			"a. one\nb. two\nc. three",
+		},
+		{
+			`<ol type="I" start="3"><li>three</li><li>four</li></ol>`,
+			"III. three\nIV. four",
+		},
+		{
+			`<ol type="A" start="26"><li>z</li><li>aa</li></ol>`,
+			"Z. z\nAA. aa",
+		},
+		{
+			`<ol type="I"><li>part<ol type="a"><li>sub<ol type="i"><li>item</li><li>item</li></ol></li><li>sub</li></ol></li><li>part</li></ol>`,
+			"I. part\n  a. sub\n    i. item\n    ii. item\n  b. sub\nII. part",
+		},
+		{
+			`<ol type="i" start="0"><li>zero</li><li>one</li></ol>`,
+			"0. zero\ni. one",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, *NewOptions()); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestTableOfContents(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+		atTop  bool
+	}{
+		{
+			`<h1>Title</h1><p>intro</p><h2>Part <em>one</em></h2><h3>Detail</h3><h4>Minor</h4><h2>Part two</h2>`,
+			"# Title\n\nintro\n\n## Part one\n\n### Detail\n\nMinor\n\n## Part two\n\n* Title\n  * Part one\n    * Detail\n      * Minor\n  * Part two",
+			false,
+		},
+		{
+			`<h2>First</h2><p>text</p><h3>Second</h3>`,
+			"* First\n  * Second\n\n## First\n\ntext\n\n### Second",
+			true,
+		},
+		{
+			`<h2></h2><p>no headings</p>`,
+			"## \n\nno headings",
+			true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := NewOptions()
+		options.GenerateTOC = true
+		options.TOCAtTop = testCase.atTop
+		if msg, err := wantString(testCase.input, testCase.output, *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestLinkEscapingIsStable(t *testing.T) {
+	hrefs := []string{
+		"foo spaced",
+		"foo%20spaced",
+		"foo?bar+baz",
+		"100% off",
+		"https://例え.jp/ページ?q=café",
+		"/caf%C3%A9 caf%c3%a9",
+	}
+
+	linkURL := func(href string) (string, error) {
+		text, err := FromString(`<a href="`+href+`">display</a>`, *NewTraverseContext(*NewOptions()))
+		if err != nil {
+			return "", err
+		}
+		fields := strings.Fields(text[strings.Index(text, "=>"):])
+		return fields[1], nil
+	}
+
+	for _, href := range hrefs {
+		once, err := linkURL(href)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		twice, err := linkURL(once)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if once != twice {
+			t.Errorf("escaping %q is not stable: %q then %q", href, once, twice)
+		}
+	}
+}
+
+func TestParseCharsets(t *testing.T) {
+	htmlFiles := []struct {
+		file                  string
+		charset               string
+		keywordShouldNotExist string
+		keywordShouldExist    string
+	}{
+		{
+			"latin1.html",
+			"",
+			"Café title",
+			"Crème brûlée à la française, © Édouard.",
+		},
+		{
+			"latin1_undeclared.html",
+			"",
+			"Café title",
+			"Crème brûlée à la française, © Édouard.",
+		},
+		{
+			"latin1_undeclared.html",
+			"iso-8859-1",
+			"Café title",
+			"Crème brûlée à la française, © Édouard.",
+		},
+		{
+			"utf8.html",
+			"utf-8",
+			"学习之道:美国公认学习第一书title",
+			"次世界冠军赛上，我几近疯狂",
+		},
+	}
+
+	for _, htmlFile := range htmlFiles {
+		bs, err := ioutil.ReadFile(path.Join(destPath, htmlFile.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := NewTraverseContext(Options{Charset: htmlFile.charset})
+		text, err := FromReader(bytes.NewReader(bs), *ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(text, htmlFile.keywordShouldExist) {
+			t.Fatalf("keyword %s should exist in file %s with charset %q", htmlFile.keywordShouldExist, htmlFile.file, htmlFile.charset)
+		}
+		if strings.Contains(text, htmlFile.keywordShouldNotExist) {
+			t.Fatalf("keyword %s should not exist in file %s with charset %q", htmlFile.keywordShouldNotExist, htmlFile.file, htmlFile.charset)
+		}
+	}
+
+	ctx := NewTraverseContext(Options{Charset: "no-such-charset"})
+	if _, err := FromString("<p>text</p>", *ctx); err == nil {
+		t.Error("expected an error for an unknown charset")
+	}
+}
+
+func TestTitle(t *testing.T) {
+	testCases := []struct {
+		input  string
+		title  string
+		output string
+	}{
+		{
+			"<html><head><title> My\n page </title></head><body><p>Text</p></body></html>",
+			"My page",
+			"# My page\n\nText",
+		},
+		{
+			"<html><head><title>My page</title></head><body><h1>Heading</h1><p>Text</p></body></html>",
+			"My page",
+			"# Heading\n\nText",
+		},
+		{
+			"<html><body><svg><title>icon</title></svg><p>Text</p></body></html>",
+			"",
+			"icon Text",
+		},
+		{
+			"<p>Text</p>",
+			"",
+			"Text",
+		},
+	}
+
+	for _, testCase := range testCases {
+		doc, err := html.Parse(strings.NewReader(testCase.input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if title, err := TitleFromHTMLNode(doc); err != nil {
+			t.Error(err)
+		} else if title != testCase.title {
+			t.Errorf("title of %q: got %q, want %q", testCase.input, title, testCase.title)
+		}
+
+		options := NewOptions()
+		options.PromoteTitleToHeading = true
+		if msg, err := wantString(testCase.input, testCase.output, *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestTaskLists(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			`<ul><li><input type="checkbox" checked disabled> done</li><li><input type="checkbox" disabled> to do</li></ul>`,
+			"* [x] done\n* [ ] to do",
+		},
+		{
+			`<ul><li><p><input type="checkbox"> in a <em>paragraph</em></p></li><li>not a task <input type="checkbox"></li></ul>`,
+			"* [ ] in a *paragraph*\n* not a task",
+		},
+		{
+			`<ul><li><input type="checkbox" checked> see <a href="/x">the link</a></li></ul>`,
+			"=> /x [x] see the link",
+		},
+		{
+			`<ol><li><input type="text"> first</li><li><input type="checkbox" checked> second</li></ol>`,
+			"1. first\n2. [x] second",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, *NewOptions()); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestCitationMarkerFormat(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+		format string
+	}{
+		{
+			`<p>See <a href="/a">one</a> and <a href="/b">two</a>.</p>`,
+			"See one (1) and two (2).\n\n=> /a (1) one\n=> /b (2) two",
+			"(%d)",
+		},
+		{
+			`<p>See <a href="/a">one</a> and <a href="/b">two</a>.</p>`,
+			"See one ^1 and two ^2.\n\n=> /a ^1 one\n=> /b ^2 two",
+			"^%d",
+		},
+		{
+			`<p>See <a href="/a">one</a> and <a href="/b">two</a>.</p>`,
+			"See one [1] and two [2].\n\n=> /a [1] one\n=> /b [2] two",
+			"no number",
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := NewOptions()
+		options.CitationMarkerFormat = testCase.format
+		if msg, err := wantString(testCase.input, testCase.output, *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestCitationsAtEndOnly(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			`<p>See <a href="/a">one</a> and <a href="/b">two</a>.</p><h1>Heading</h1><p>See <a href="/c">three</a> and <a href="/d">four</a>.</p><blockquote>Quote <a href="/e">five</a> and <a href="/f">six</a>.</blockquote>`,
+			"See one [1] and two [2].\n\n# Heading\n\nSee three [3] and four [4].\n\n> Quote five [5] and six [6].\n\n=> /a [1] one\n=> /b [2] two\n=> /c [3] three\n=> /d [4] four\n=> /e [5] five\n=> /f [6] six",
+		},
+		{
+			`<table><tr><td><a href="/a">one</a></td></tr></table><p>after</p>`,
+			"⊞ table ⊞\n\none [1]\n\nafter\n\n=> /a [1] one",
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := NewOptions()
+		options.CitationsAtEndOnly = true
+		if msg, err := wantString(testCase.input, testCase.output, *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+
+	//the links are still listed once, at the very end, with citations per section or the
+	//navigation and footers placed at the end
+	perSection := NewOptions(WithCitationsAtEndOnly())
+	perSection.CitationsPerSection = true
+	appendix := NewOptions(WithCitationsAtEndOnly())
+	appendix.NavFooterPlacement = NavFooterAppendix
+	combinedCases := []struct {
+		input   string
+		options *Options
+		output  string
+	}{
+		{
+			`<h1>One</h1><p>See <a href="/a">a</a> and <a href="/b">b</a>.</p><h1>Two</h1><p>See <a href="/c">c</a> and <a href="/a">a</a>.</p>`,
+			perSection,
+			"# One\n\nSee a [1] and b [2].\n\n# Two\n\nSee c [3] and a [4].\n\n=> /a [1] a\n=> /b [2] b\n=> /c [3] c\n=> /a [4] a",
+		},
+		{
+			`<nav><a href="/">Home</a></nav><p>Read <a href="/a">this</a> and <a href="/b">that</a>.</p><footer>© <a href="/me">Me</a> 2024</footer>`,
+			appendix,
+			"Read this [1] and that [2].\n\n## Navigation\n\nHome [3]\n\n## Footer\n\n© Me [4] 2024\n\n=> /a [1] this\n=> /b [2] that\n=> / [3] Home\n=> /me [4] Me",
+		},
+	}
+
+	for _, testCase := range combinedCases {
+		if msg, err := wantString(testCase.input, testCase.output, *testCase.options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestCitationsPerSection(t *testing.T) {
+	input := `<h1>One</h1><p>See <a href="/a">a</a> and <a href="/b">b</a>.</p><h2>Sub</h2><p>See <a href="/c">c</a> and <a href="/d">d</a>.</p><h1>Two</h1><p>See <a href="/e">e</a> and <a href="/a">a</a>.</p>`
+	testCases := []struct {
+		level  int
+		dedupe bool
+		output string
+	}{
+		{
+			0,
+			false,
+			"# One\n\nSee a [1] and b [2].\n\n=> /a [1] a\n=> /b [2] b\n\n## Sub\n\nSee c [3] and d [4].\n\n=> /c [3] c\n=> /d [4] d\n\n# Two\n\nSee e [1] and a [2].\n\n=> /e [1] e\n=> /a [2] a",
+		},
+		{
+			2,
+			false,
+			"# One\n\nSee a [1] and b [2].\n\n=> /a [1] a\n=> /b [2] b\n\n## Sub\n\nSee c [1] and d [2].\n\n=> /c [1] c\n=> /d [2] d\n\n# Two\n\nSee e [1] and a [2].\n\n=> /e [1] e\n=> /a [2] a",
+		},
+		{
+			1,
+			true,
+			"# One\n\nSee a [1] and b [2].\n\n=> /a [1] a\n=> /b [2] b\n\n## Sub\n\nSee c [3] and d [4].\n\n=> /c [3] c\n=> /d [4] d\n\n# Two\n\nSee e [1] and a [2].\n\n=> /e [1] e\n=> /a [2] a",
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := NewOptions()
+		options.CitationsPerSection = true
+		options.CitationSectionLevel = testCase.level
+		options.DeduplicateLinks = testCase.dedupe
+		if msg, err := wantString(input, testCase.output, *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestMediaLinkGrouping(t *testing.T) {
+	input := `<p><img src="/a.png" alt="A"> see <a href="/page">page</a> and <video src="/v.mp4" title="Clip"></video> or <a href="/other">other</a></p>`
+	testCases := []struct {
+		prefix string
+		group  bool
+		output string
+	}{
+		{
+			"",
+			false,
+			"[‡ A] [1] see page [2] and [Clip] [3] or other [4]\n\n=> /a.png [1] [‡ A]\n=> /page [2] page\n=> /v.mp4 [3] [Clip]\n=> /other [4] other",
+		},
+		{
+			"🖼",
+			false,
+			"[‡ A] [1] see page [2] and [Clip] [3] or other [4]\n\n=> /a.png 🖼 [1] [‡ A]\n=> /page [2] page\n=> /v.mp4 🖼 [3] [Clip]\n=> /other [4] other",
+		},
+		{
+			"",
+			true,
+			"[‡ A] [1] see page [2] and [Clip] [3] or other [4]\n\n=> /page [2] page\n=> /other [4] other\n\n=> /a.png [1] [‡ A]\n=> /v.mp4 [3] [Clip]",
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := NewOptions()
+		options.MediaLinkPrefix = testCase.prefix
+		options.GroupMediaLinks = testCase.group
+		if msg, err := wantString(input, testCase.output, *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+
+	doc, err := html.Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	links, _, err := LinksFromHTMLNode(doc, *NewTraverseContext(*NewOptions()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range links {
+		if want := link.URL == "/a.png" || link.URL == "/v.mp4"; link.Media != want {
+			t.Errorf("link %q: got Media %v, want %v", link.URL, link.Media, want)
+		}
+	}
+}
+
+func TestPreferTitleAttribute(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+		prefer bool
+	}{
+		{
+			`<p>For the report <a href="/r" title="Annual report 2020">click here</a>, or <a href="/o">other</a>.</p>`,
+			"For the report click here [1], or other [2].\n\n=> /r [1] click here\n=> /o [2] other",
+			false,
+		},
+		{
+			`<p>For the report <a href="/r" title=" Annual
+ report 2020">click here</a>, or <a href="/o" title="">other</a>.</p>`,
+			"For the report click here [1], or other [2].\n\n=> /r [1] Annual report 2020\n=> /o [2] other",
+			true,
+		},
+		{
+			`<p>See <a href="/r" title="The report"><img src="/r.png" alt="R"></a> now.</p>`,
+			"See [‡ R] [1] [2] now.\n\n=> /r.png [1] [‡ R]\n=> /r [2] The report",
+			true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := NewOptions()
+		options.PreferTitleAttribute = testCase.prefer
+		if msg, err := wantString(testCase.input, testCase.output, *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestMaxConsecutiveBreaks(t *testing.T) {
+	input := `a<br>b<br><br>c<br><br><br><br>d<br> <br> <br>e<br><br><br>`
+	testCases := []struct {
+		max    int
+		output string
+	}{
+		{
+			0,
+			"a\nb\n\nc\n\nd\n\ne",
+		},
+		{
+			1,
+			"a\nb\nc\nd\ne",
+		},
+		{
+			3,
+			"a\nb\n\nc\n\n\nd\n\n\ne",
+		},
+		{
+			5,
+			"a\nb\n\nc\n\n\n\nd\n\n\ne",
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := NewOptions()
+		options.MaxConsecutiveBreaks = testCase.max
+		if msg, err := wantString(input, testCase.output, *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+
+	//the mark keeping the extra blank lines stays out of the text of links
+	options := NewOptions()
+	options.MaxConsecutiveBreaks = 3
+	for _, input := range []string{
+		`<p><a href="/x">a<br><br><br>b</a></p>`,
+		`<a href="/x"><div>a<br><br><br>b</div></a>`,
+	} {
+		doc, err := html.Parse(strings.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		links, _, err := LinksFromHTMLNode(doc, *NewTraverseContext(*options))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, link := range links {
+			if strings.Contains(link.Display, blankLineMark) {
+				t.Errorf("got link text %q for %s, want it without the blank line mark", link.Display, input)
+			}
+		}
+	}
+
+	//breaks before or after all the text leave no blank lines behind
+	options = NewOptions()
+	options.MaxConsecutiveBreaks = 5
+	for _, input := range []string{
+		`<br><br><br><br><br>text`,
+		`text<br><br><br><br><br>`,
+		`<p><br><br><br><br><br>text<br><br><br><br><br></p>`,
+	} {
+		if msg, err := wantString(input, "text", *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestFormattingInHeadings(t *testing.T) {
+	input := `<h2>The <code>emit</code> <em>method</em> is <strong>fast</strong></h2><p>Some <em>text</em>.</p>`
+	testCases := []struct {
+		keep   bool
+		output string
+	}{
+		{
+			false,
+			"## The emit method is fast\n\nSome *text*.",
+		},
+		{
+			true,
+			"## The `emit` *method* is *fast*\n\nSome *text*.",
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := NewOptions()
+		options.FormattingInHeadings = testCase.keep
+		if msg, err := wantString(input, testCase.output, *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestAddress(t *testing.T) {
+	input := `Text<address>Jane Doe<br>1 Main Street<br><a href="mailto:jane@example.org">jane@example.org</a></address>after`
+	testCases := []struct {
+		prefix   string
+		emphasis bool
+		output   string
+	}{
+		{
+			"",
+			false,
+			"Text\n\nJane Doe\n1 Main Street\njane@example.org\n\nafter",
+		},
+		{
+			"✉ ",
+			true,
+			"Text\n\n✉ *Jane Doe\n1 Main Street\njane@example.org*\n\nafter",
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := NewOptions()
+		options.AddressPrefix = testCase.prefix
+		options.EmphasizeAddress = testCase.emphasis
+		if msg, err := wantString(input, testCase.output, *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestImageAltOnly(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			`<p>A <img src="/chart.png" alt="chart of  sales"> here</p>`,
+			"A chart of sales here",
+		},
+		{
+			`<p>A <img src="/spacer.gif" alt=""><img src="data:image/png;base64,AAAA" alt="dot" role="presentation"><img src="/no-alt.png"> here</p>`,
+			"A here",
+		},
+		{
+			`<p>See <a href="/sales"><img src="/chart.png" alt="sales"></a> and more text</p>`,
+			"=> /sales See sales and more text",
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := NewOptions()
+		options.ImageAltOnly = true
+		if msg, err := wantString(testCase.input, testCase.output, *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestImageSrcset(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			`<img src="tiny.gif" srcset="a.jpg, b.jpg 2x,c.jpg 1.5x" alt="A">`,
+			"[‡ A] [1]\n\n=> b.jpg [1] [‡ A]",
+		},
+		{
+			`<img src="tiny.gif" srcset="data:image/png;base64,AA,BB 1x, big.png 800w, small.png 200w">`,
+			"[‡ big] [1]\n\n=> big.png [1] [‡ big]",
+		},
+		{
+			`<picture><source srcset="p.webp 1x, p2.webp 2x" type="image/webp"><source srcset="p.jpg"><img src="fallback.jpg" alt="P"></picture>`,
+			"[‡ P] [1]\n\n=> p2.webp [1] [‡ P]",
+		},
+		{
+			`<picture><source media="(min-width: 800px)"><img src="fallback.jpg" alt="P"></picture>`,
+			"[‡ P] [1]\n\n=> fallback.jpg [1] [‡ P]",
+		},
+		{
+			`<img src="plain.png" srcset=" , " alt="Plain">`,
+			"[‡ Plain] [1]\n\n=> plain.png [1] [‡ Plain]",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, *NewOptions()); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestLazyImages(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			`<img data-src=real.jpg alt="Real">`,
+			"[‡ Real] [1]\n\n=> real.jpg [1] [‡ Real]",
+		},
+		{
+			`<img src="/img/placeholder.gif" data-original="/img/photo.jpg">`,
+			"[‡ photo] [1]\n\n=> /img/photo.jpg [1] [‡ photo]",
+		},
+		{
+			`<img src="data:image/gif;base64,R0lGODlhAQABAAAAACw=" data-lazy-src="/img/photo.jpg" alt="Photo">`,
+			"[‡ Photo] [1]\n\n=> /img/photo.jpg [1] [‡ Photo]",
+		},
+		{
+			`<img src="/img/photo.jpg" data-src="/img/other.jpg" alt="Photo">`,
+			"[‡ Photo] [1]\n\n=> /img/photo.jpg [1] [‡ Photo]",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, *NewOptions()); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+
+	options := NewOptions()
+	options.LazyImageAttrs = []string{"data-srcset"}
+	if msg, err := wantString(`<img src="" data-srcset="small.jpg 1x, large.jpg 2x" data-src="real.jpg" alt="A">`, "[‡ A] [1]\n\n=> large.jpg [1] [‡ A]", *options); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+}
+
+func TestResultFromHTMLNode(t *testing.T) {
+	input := `<h1>Title</h1><p>See <a href="/a">a</a> and <img src="/b.png" alt="B">.</p>
+<ul><li><img src="/c.png" alt="C"> item</li></ul>
+<h2>Tables</h2><table><tr><td><img src="/d.png" alt="D"><table><tr><td>nested</td></tr></table></td></tr></table>`
+
+	doc, err := html.Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pretty := range []bool{false, true} {
+		options := NewOptions()
+		options.PrettyTables = pretty
+		result, err := ResultFromHTMLNode(doc, *NewTraverseContext(*options))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.ImageCount != 3 || result.TableCount != 2 || result.HeadingCount != 2 || len(result.Links) != 4 {
+			t.Errorf("pretty tables %v: got %d images, %d tables, %d headings and %d links, want 3, 2, 2 and 4",
+				pretty, result.ImageCount, result.TableCount, result.HeadingCount, len(result.Links))
+		}
+
+		text, err := FromHTMLNode(doc, *NewTraverseContext(*options))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Text != text {
+			t.Errorf("pretty tables %v: got text %q, want %q", pretty, result.Text, text)
+		}
+	}
+}
+
+func TestFunctionalOptions(t *testing.T) {
+	options := NewOptions(
+		WithPrettyTables(TableStyleMarkdown),
+		WithCitationStart(10),
+		WithLinkEmitFrequency(5),
+		WithWrapWidth(40),
+		WithBaseURL("gemini://example.org/"),
+	)
+	if !options.PrettyTables || options.TableStyle != TableStyleMarkdown || options.CitationStart != 10 ||
+		options.LinkEmitFrequency != 5 || options.WrapWidth != 40 || options.BaseURL != "gemini://example.org/" {
+		t.Errorf("options not applied: %+v", options)
+	}
+
+	//the other settings keep their defaults
+	if defaults := NewOptions(); options.BulletMarker != defaults.BulletMarker || options.NumberedLinks != defaults.NumberedLinks {
+		t.Errorf("defaults not kept: %+v", options)
+	}
+
+	if msg, err := wantString(`<p>See <a href="/a">a</a> and <a href="/b">b</a>.</p>`, "See a and b.", *NewOptions(WithOmitLinks())); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+}
+
+func TestCitationStart(t *testing.T) {
+	testCases := []struct {
+		start  int
+		output string
+	}{
+		{
+			0,
+			"See a [1] and b [2].\n\n=> /a [1] a\n=> /b [2] b",
+		},
+		{
+			50,
+			"See a [50] and b [51].\n\n=> /a [50] a\n=> /b [51] b",
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := NewOptions()
+		options.CitationStart = testCase.start
+		if msg, err := wantString(`<p>See <a href="/a">a</a> and <a href="/b">b</a>.</p>`, testCase.output, *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestFromReaderContext(t *testing.T) {
+	input := strings.Repeat(`<p>Some <em>text</em> and <a href="/link">a link</a>.</p>`, 1000)
+
+	text, err := FromReaderContext(context.Background(), strings.NewReader(input), *NewTraverseContext(*NewOptions()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := FromString(input, *NewTraverseContext(*NewOptions()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != want {
+		t.Error("text rendered with a context differs from that rendered without")
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := FromReaderContext(cancelled, strings.NewReader(input), *NewTraverseContext(*NewOptions())); err != context.Canceled {
+		t.Errorf("got error %v for a cancelled context, want %v", err, context.Canceled)
+	}
+
+	//cancel part way through rendering
+	running, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	options := NewOptions()
+	options.ElementHandlers = map[atom.Atom]ElementHandler{
+		atom.Em: func(ctx *TextifyTraverseContext, node *html.Node) (bool, error) {
+			cancel()
+			return false, nil
+		},
+	}
+	if _, err := FromReaderContext(running, strings.NewReader(input), *NewTraverseContext(*options)); err != context.Canceled {
+		t.Errorf("got error %v for a context cancelled while rendering, want %v", err, context.Canceled)
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	const depth = 3000
+	input := "<p>top</p>" + strings.Repeat("<div>", depth) + "deep" + strings.Repeat("</div>", depth) + "<p>bottom</p>"
+
+	if _, err := FromString(input, *NewTraverseContext(*NewOptions())); err != ErrMaxDepth {
+		t.Errorf("got error %v, want %v", err, ErrMaxDepth)
+	}
+	if _, err := FromString(input, *NewTraverseContext(Options{})); err != ErrMaxDepth {
+		t.Errorf("got error %v with zero options, want %v", err, ErrMaxDepth)
+	}
+
+	options := NewOptions()
+	options.TruncateAtMaxDepth = true
+	if msg, err := wantString(input, "top\n\nbottom", *options); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+
+	options = NewOptions()
+	options.MaxDepth = -1
+	if msg, err := wantString(input, "top\ndeep\nbottom", *options); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+}
+
+func TestMaxOutputSize(t *testing.T) {
+	input := strings.Repeat("<p>Lorem ipsum dolor sit amet.</p>", 1000)
+
+	options := NewOptions()
+	options.MaxOutputSize = 100
+	if _, err := FromString(input, *NewTraverseContext(*options)); err != ErrMaxOutputSize {
+		t.Errorf("got error %v, want %v", err, ErrMaxOutputSize)
+	}
+	if err := FromReaderToWriter(strings.NewReader(input), ioutil.Discard, *NewTraverseContext(*options)); err != ErrMaxOutputSize {
+		t.Errorf("got error %v when streaming, want %v", err, ErrMaxOutputSize)
+	}
+
+	options.TruncateAtMaxOutputSize = true
+	if msg, err := wantString(input, "Lorem ipsum dolor sit amet.\nLorem ipsum dolor sit amet.\nLorem ipsum dolor sit amet.\nLorem ipsum dolo...", *options); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+
+	options.MaxOutputSize = 10000
+	buf := &strings.Builder{}
+	if err := FromReaderToWriter(strings.NewReader(input), buf, *NewTraverseContext(*options)); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); !strings.HasSuffix(got, "...") || len(got) > options.MaxOutputSize+len(truncationEllipsis) {
+		t.Errorf("got %d bytes ending %q when streaming, want at most %d ending with an ellipsis", len(got), got[len(got)-40:], options.MaxOutputSize)
+	}
+
+	//no limit by default
+	if _, err := FromString(input, *NewTraverseContext(*NewOptions())); err != nil {
+		t.Error(err)
+	}
+
+	//the links listed at the end count too
+	links := "<p>" + strings.Repeat(`<a href="http://example.com/a/long/path/to/a/page">a</a> `, 8) + "</p>"
+	options = NewOptions()
+	options.MaxOutputSize = 100
+	if _, err := FromString(links, *NewTraverseContext(*options)); err != ErrMaxOutputSize {
+		t.Errorf("got error %v with links, want %v", err, ErrMaxOutputSize)
+	}
+	options.TruncateAtMaxOutputSize = true
+	if text, err := FromString(links, *NewTraverseContext(*options)); err != nil {
+		t.Error(err)
+	} else if len(text) > options.MaxOutputSize+len(truncationEllipsis) || !strings.HasSuffix(text, truncationEllipsis) {
+		t.Errorf("got %d bytes ending %q with links, want at most %d ending with an ellipsis", len(text), text, options.MaxOutputSize)
+	}
+}
+
+func BenchmarkFromReader(b *testing.B) {
+	bs, err := ioutil.ReadFile(path.Join(destPath, "utf8.html"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	options := *NewOptions()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := FromReader(bytes.NewReader(bs), *NewTraverseContext(options)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkDocument renders a document of paragraphs and list items, each with the
+// given inline content.
+func benchmarkDocument(b *testing.B, content string) {
+	var sb strings.Builder
+	for i := 0; i < 200; i++ {
+		sb.WriteString("<p>" + content + "</p><ul><li>" + content + "</li><li>" + content + "<ul><li>" + content + "</li></ul></li></ul>")
+	}
+	input := sb.String()
+	options := *NewOptions()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := FromString(input, *NewTraverseContext(options)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLinkFreeDocument(b *testing.B) {
+	benchmarkDocument(b, "Some <em>plain</em> text, with <strong>no links</strong> at all in it.")
+}
+
+func BenchmarkLinkedDocument(b *testing.B) {
+	benchmarkDocument(b, `Some <em>plain</em> text, with <a href="/a">one</a> or <a href="/b">two</a> links in it.`)
+}
+
+func BenchmarkNestedListItems(b *testing.B) {
+	item := `A long list item, with <em>some</em> text and <a href="/a">one</a> or <a href="/b">two</a> links in it, followed by its own list. `
+	var sb strings.Builder
+	for i := 0; i < 20; i++ {
+		for depth := 0; depth < 8; depth++ {
+			sb.WriteString("<ul><li>" + item)
+		}
+		for depth := 0; depth < 8; depth++ {
+			sb.WriteString("</li></ul>")
+		}
+	}
+	input := sb.String()
+	options := *NewOptions()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := FromString(input, *NewTraverseContext(options)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestPreformattedWhitespace(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"<pre>\tindented\n\t\tmore\n  two spaces\nnone</pre>",
+			"```\n\tindented\n\t\tmore\n  two spaces\nnone\n```",
+		},
+		{
+			"<p>Intro</p><pre>\tcode\n  more</pre>",
+			"Intro\n\n```\n\tcode\n  more\n```",
+		},
+		{
+			"Some text<pre> \tcode</pre>after",
+			"Some text\n\n```\n \tcode\n```\n\nafter",
+		},
+		{
+			"<pre><code>\tfunc main() {\n\n\n\t}</code></pre>",
+			"```\n\tfunc main() {\n\n\n\t}\n```",
+		},
+		{
+			"<ul><li><pre>\tcode</pre></li></ul>",
+			"* \n```\n\tcode\n```",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestDisableInlineFormatting(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"<b>x</b>",
+			"x",
+		},
+		{
+			"Some <strong>bold</strong>, <em>emphasised</em>, <del>struck</del> and <code>code</code> text",
+			"Some bold, emphasised, struck and code text",
+		},
+		{
+			"<dl><dt>Term</dt><dd>Definition</dd></dl>",
+			"Term\n  Definition",
+		},
+		{
+			"<pre><code>fenced  code</code></pre>",
+			"```\nfenced  code\n```",
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := NewOptions()
+		options.DisableInlineFormatting = true
+		if msg, err := wantString(testCase.input, testCase.output, *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestInsertions(t *testing.T) {
+	input := "<p>Price: <del>£10</del><ins>£8</ins> today</p>"
+	testCases := []struct {
+		marker string
+		output string
+	}{
+		{
+			"++",
+			"Price: ~~£10~~ ++£8++ today",
+		},
+		{
+			"_",
+			"Price: ~~£10~~ _£8_ today",
+		},
+		{
+			"",
+			"Price: ~~£10~~ £8 today",
+		},
+	}
+
+	//inserted text is left as it is by default
+	if msg, err := wantString(input, "Price: ~~£10~~ £8 today", *NewOptions()); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+
+	for _, testCase := range testCases {
+		options := NewOptions()
+		options.InsertionMarker = testCase.marker
+		if msg, err := wantString(input, testCase.output, *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestNormalizePunctuation(t *testing.T) {
+	input := "<p>“Don’t,” she said — it’s only ‘fine’ for pages 3–5…</p><pre>“as is” — …</pre><p>Use <code>‘quoted’</code></p>"
+	testCases := []struct {
+		normalize bool
+		output    string
+	}{
+		{
+			false,
+			"“Don’t,” she said — it’s only ‘fine’ for pages 3–5…\n\n```\n“as is” — …\n```\n\nUse `‘quoted’`",
+		},
+		{
+			true,
+			"\"Don't,\" she said -- it's only 'fine' for pages 3-5...\n\n```\n“as is” — …\n```\n\nUse `‘quoted’`",
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := NewOptions()
+		options.NormalizePunctuation = testCase.normalize
+		if msg, err := wantString(input, testCase.output, *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestWordBreaks(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"<p>super<wbr>cali<wbr>fragilistic</p>",
+			"supercalifragilistic",
+		},
+		{
+			"<p><em>super</em><wbr>cali</p>",
+			"*super*cali",
+		},
+		{
+			"<p>two<wbr> words</p>",
+			"two words",
+		},
+		{
+			`<p>See http://example.com/<wbr>path and <a href="/x">link<wbr>text</a></p>`,
+			"=> /x See http://example.com/path and linktext",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, *NewOptions()); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestRuby(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+		omit   string
+	}{
+		{
+			"<p><ruby>漢<rt>kan</rt>字<rt>ji</rt></ruby> next</p>",
+			"漢(kan)字(ji) next",
+			"漢字 next",
+		},
+		{
+			"<p>Say <ruby>漢<rp>(</rp><rt>kan</rt><rp>)</rp>字<rp>(</rp><rt>ji</rt><rp>)</rp></ruby>, please</p>",
+			"Say 漢(kan)字(ji), please",
+			"Say 漢字, please",
+		},
+		{
+			"<p>A <ruby>\n  東 <rt>とう</rt>\n  京 <rt>きょう</rt>\n</ruby> B</p>",
+			"A 東(とう)京(きょう) B",
+			"A 東京 B",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, *NewOptions()); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+
+		options := NewOptions()
+		options.RubyStyle = RubyStyleOmit
+		if msg, err := wantString(testCase.input, testCase.omit, *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestInvisibleCharacters(t *testing.T) {
+	input := "<p>a&nbsp;b&nbsp;&nbsp;c</p><p>zero&#8203;width, join&#8205;ed, soft&shy;hyphen</p>"
+	testCases := []struct {
+		normalizeNBSP bool
+		strip         bool
+		output        string
+	}{
+		{
+			false,
+			false,
+			"a\u00a0b\u00a0\u00a0c\nzero\u200bwidth, join\u200ded, soft\u00adhyphen",
+		},
+		{
+			true,
+			false,
+			"a b c\nzero\u200bwidth, join\u200ded, soft\u00adhyphen",
+		},
+		{
+			false,
+			true,
+			"a\u00a0b\u00a0\u00a0c\nzerowidth, joined, softhyphen",
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := NewOptions()
+		options.NormalizeNBSP = testCase.normalizeNBSP
+		options.StripInvisibleCharacters = testCase.strip
+		if msg, err := wantString(input, testCase.output, *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestPriceReplacements(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"<p>Now <del>$99</del> <ins>$59</ins> only</p>",
+			"Now $99 → $59 only",
+		},
+		{
+			"<p><s>€12,50</s><ins><b>€9,99</b></ins></p>",
+			"€12,50 → *€9,99*",
+		},
+		{
+			//not prices, so marked as usual
+			"<p>The <del>colour</del> <ins>color</ins> changed</p>",
+			"The ~~colour~~ ++color++ changed",
+		},
+		{
+			"<p><del>$99</del> was the price</p>",
+			"~~$99~~ was the price",
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := NewOptions()
+		options.PriceReplacementArrow = "→"
+		options.InsertionMarker = "++"
+		if msg, err := wantString(testCase.input, testCase.output, *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+
+	options := NewOptions()
+	options.InsertionMarker = "++"
+	if msg, err := wantString("<p>Now <del>$99</del> <ins>$59</ins> only</p>", "Now ~~$99~~ ++$59++ only", *options); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+}
+
+func TestHighlights(t *testing.T) {
+	input := "<p>Results for <mark>gemini</mark> capsules</p>"
+	testCases := []struct {
+		marker string
+		output string
+	}{
+		{
+			"==",
+			"Results for ==gemini== capsules",
+		},
+		{
+			"",
+			"Results for gemini capsules",
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := NewOptions()
+		options.HighlightMarker = testCase.marker
+		if msg, err := wantString(input, testCase.output, *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestIframes(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			`Watch <iframe src="https://www.youtube.com/embed/xyz" title="Launch video"></iframe> now`,
+			"Watch [Launch video] [1] now\n\n=> https://www.youtube.com/embed/xyz [1] [Launch video]",
+		},
+		{
+			`<iframe name="map" src="/map.html"></iframe>`,
+			"[map] [1]\n\n=> /map.html [1] [map]",
+		},
+		{
+			`<iframe src="/tweet.html"></iframe>`,
+			"[embedded content] [1]\n\n=> /tweet.html [1] [embedded content]",
+		},
+		{
+			`Before<iframe src="about:blank"></iframe><iframe></iframe> after`,
+			"Before after",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, *NewOptions()); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+
+	if msg, err := wantString(`Before<iframe src="/map.html"></iframe> after`, "Before after"); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+}
+
+func TestSectioningElements(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"<section>One</section><section>Two</section>",
+			"One\n\nTwo",
+		},
+		{
+			"<header>Site</header><main><article>First</article><article>Second</article></main>",
+			"Site\n\nFirst\n\nSecond",
+		},
+		{
+			"<p>Main text</p><aside>A tangent</aside><p>More text</p>",
+			"Main text\n\nAside: A tangent\n\nMore text",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, *NewOptions()); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestOmitImages(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			`<p>Before <img src="/chart.png" alt="Chart"> after</p>`,
+			"Before after",
+		},
+		{
+			`Logo: <a href="/home"><img src="/logo.png" alt="Logo"></a> end`,
+			"Logo: end",
+		},
+		{
+			`See <a href="/gallery"><img src="/thumb.png" alt="Thumbnail">the gallery</a> here`,
+			"See the gallery [1] here\n\n=> /gallery [1]",
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := NewOptions()
+		options.OmitImages = true
+		if msg, err := wantString(testCase.input, testCase.output, *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestAnnotateDownloads(t *testing.T) {
+	testCases := []struct {
+		input  string
+		marker string
+		output string
+	}{
+		{
+			`Get <a href="/report.pdf">the report</a> or read <a href="/about.html">about it</a>`,
+			"",
+			"Get the report (pdf) [1] or read about it [2]\n\n=> /report.pdf [1] the report (pdf)\n=> /about.html [2] about it",
+		},
+		{
+			`Data: <a href="/export?format=csv" download>Export</a>`,
+			"",
+			"Data: Export (file) [1]\n\n=> /export?format=csv [1] Export (file)",
+		},
+		{
+			`<p><a href="/src/archive.tar.gz">Source code</a></p>`,
+			"",
+			"=> /src/archive.tar.gz Source code (gz)",
+		},
+		{
+			`<p><a href="/book.epub">Book</a></p>`,
+			"[%s download]",
+			"=> /book.epub Book [epub download]",
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := NewOptions()
+		options.AnnotateDownloads = true
+		options.DownloadMarker = testCase.marker
+		if msg, err := wantString(testCase.input, testCase.output, *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestBlockLinks(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			`<a href="/post"><div><h3>Title</h3><p>A description of the post.</p></div></a>`,
+			"### Title\n\nA description of the post. [1]\n\n=> /post [1] Title",
+		},
+		{
+			`<a href="/post"><div>A <em>card</em></div><div>without a heading</div></a>`,
+			"A *card*\nwithout a heading [1]\n\n=> /post [1] A *card* without a heading",
+		},
+		{
+			`<blockquote><a href="/quote"><p>Quoted card</p></a></blockquote>`,
+			"> Quoted card [1]\n\n=> /quote [1] Quoted card",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, *NewOptions()); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestPlainText(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"<h1>Title</h1><h2>Sub</h2><h3>Minor</h3><p>Text</p>",
+			"Title\n\nSub\n\nMinor\n\nText",
+		},
+		{
+			"<ul><li>one</li><li>two<ul><li>nested</li></ul></li></ul>",
+			"- one\n- two\n  - nested",
+		},
+		{
+			"<ol><li>first</li><li>second</li></ol>",
+			"1. first\n2. second",
+		},
+		{
+			`<p>Read <a href="http://example.com/">the docs</a> first.</p>`,
+			"Read the docs (http://example.com/) first.",
+		},
+		{
+			`<p><a href="http://example.com/">Single link</a></p>`,
+			"Single link (http://example.com/)",
+		},
+		{
+			`<ul><li><a href="/a">A</a></li><li><a href="/b">B</a></li></ul>`,
+			"- A (/a)\n- B (/b)",
+		},
+		{
+			"<p>Before</p><pre>code</pre><p>After</p>",
+			"Before\n\ncode\n\nAfter",
+		},
+		{
+			`<img src="/pic.png" alt="A picture">`,
+			"[‡ A picture] (/pic.png)",
+		},
+		{
+			"<blockquote><p>Quoted</p></blockquote><p>After</p>",
+			"Quoted\n\nAfter",
+		},
+		{
+			"<table><tr><td>a</td><td>b</td></tr></table>",
+			"a b",
+		},
+		{
+			"<p>```not a fence</p><pre>code\n\n\nkept</pre><p>```</p>",
+			"```not a fence\n\ncode\n\n\nkept\n\n```",
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := NewOptions(WithOutputFormat(OutputFormatPlainText))
+		if msg, err := wantString(testCase.input, testCase.output, *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+
+	//links are inline whatever the link style
+	options := NewOptions(WithOutputFormat(OutputFormatPlainText), WithLinkStyle(LinkStyleFootnoteImmediate))
+	if msg, err := wantString(`<p>See <a href="/a">this</a>.</p>`, "See this (/a).", *options); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+}
+
+func TestCitationStyle(t *testing.T) {
+	input := `<p>Read <a href="/a">a</a>, <a href="/b">b</a> and <a href="/c">c</a> first.</p><p>More words here.</p>`
+	testCases := []struct {
+		style  CitationStyle
+		output string
+	}{
+		{
+			CitationStyleNone,
+			"Read a, b and c first.\n\nMore words here.\n\n=> /a a\n=> /b b\n=> /c c",
+		},
+		{
+			CitationStyleNumbered,
+			"Read a [1], b [2] and c [3] first.\n\nMore words here.\n\n=> /a [1] a\n=> /b [2] b\n=> /c [3] c",
+		},
+		{
+			CitationStyleSymbol,
+			"Read a [*], b [†] and c [‡] first.\n\nMore words here.\n\n=> /a [*] a\n=> /b [†] b\n=> /c [‡] c",
+		},
+	}
+
+	for _, testCase := range testCases {
+		//the style wins over the separate settings for the markers and link numbers
+		for _, numbered := range []bool{false, true} {
+			options := NewOptions(WithCitationStyle(testCase.style))
+			options.CitationMarkers = !numbered
+			options.NumberedLinks = numbered
+			if msg, err := wantString(input, testCase.output, *options); err != nil {
+				t.Error(err)
+			} else if len(msg) > 0 {
+				t.Log(msg)
+			}
+		}
+	}
+
+	//left unset, either of the deprecated settings numbers the markers and the link lines alike
+	for _, options := range []Options{{CitationMarkers: true}, {NumberedLinks: true}} {
+		if msg, err := wantString(input, testCases[1].output, options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+	if msg, err := wantString(input, testCases[0].output, Options{}); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+
+	for n, want := range map[int]string{1: "*", 6: "¶", 7: "**", 13: "***"} {
+		if got := citationSymbol(n); got != want {
+			t.Errorf("got symbol %q for citation %d, want %q", got, n, want)
+		}
+	}
+}
+
+func TestLinkStyles(t *testing.T) {
+	input := `<h2>Intro</h2><p>Read <a href="/a">the docs</a> and <a href="/b">the FAQ</a> first.</p>` +
+		`<p><a href="/c">Single link</a></p><ul><li>See <a href="/d">d</a> and <a href="/e">e</a></li></ul><p>End.</p>`
+	testCases := []struct {
+		style  LinkStyle
+		output string
+	}{
+		{
+			LinkStyleCitation,
+			"## Intro\n\nRead the docs [1] and the FAQ [2] first.\n\n=> /c Single link\n\n* See d [3] and e [4]\n\nEnd.\n\n" +
+				"=> /a [1] the docs\n=> /b [2] the FAQ\n=> /d [3] d\n=> /e [4] e",
+		},
+		{
+			LinkStyleInline,
+			"## Intro\n\nRead the docs (/a) and the FAQ (/b) first.\nSingle link (/c)\n\n* See d (/d) and e (/e)\n\nEnd.",
+		},
+		{
+			LinkStyleFootnoteImmediate,
+			"## Intro\n\nRead the docs and the FAQ first.\n\n=> /a the docs\n=> /b the FAQ\n\n=> /c Single link\n\n" +
+				"* See d and e\n\n=> /d d\n=> /e e\n\nEnd.",
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := NewOptions(WithLinkStyle(testCase.style))
+		if msg, err := wantString(input, testCase.output, *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+
+	doc, err := html.Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	links, _, err := LinksFromHTMLNode(doc, *NewTraverseContext(*NewOptions(WithLinkStyle(LinkStyleInline))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(links) != 5 {
+		t.Errorf("got %d inline links, want 5: %#v", len(links), links)
+	}
+}
+
+func TestLinkLineSeparator(t *testing.T) {
+	input := `<p>Read <a href="/a">the docs</a> and <a href="/b">the FAQ</a>.</p><p><a href="/c">Single link</a></p>`
+	testCases := []struct {
+		separator string
+		output    string
+	}{
+		{
+			"",
+			"Read the docs [1] and the FAQ [2].\n\n=> /c Single link\n\n=> /a [1] the docs\n=> /b [2] the FAQ",
+		},
+		{
+			"\t",
+			"Read the docs [1] and the FAQ [2].\n\n=> /c\tSingle link\n\n=> /a\t[1] the docs\n=> /b\t[2] the FAQ",
+		},
+		{
+			"   ",
+			"Read the docs [1] and the FAQ [2].\n\n=> /c   Single link\n\n=> /a   [1] the docs\n=> /b   [2] the FAQ",
+		},
+		{
+			" | ",
+			"Read the docs [1] and the FAQ [2].\n\n=> /c Single link\n\n=> /a [1] the docs\n=> /b [2] the FAQ",
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := NewOptions()
+		options.LinkLineSeparator = testCase.separator
+		if msg, err := wantString(input, testCase.output, *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestOmitLinkDisplay(t *testing.T) {
+	input := `<p>Read <a href="/a">the docs</a> and <a href="/b">the FAQ</a>.</p>`
+	testCases := []struct {
+		style  CitationStyle
+		output string
+	}{
+		{
+			CitationStyleNumbered,
+			"Read the docs [1] and the FAQ [2].\n\n=> /a [1]\n=> /b [2]",
+		},
+		{
+			CitationStyleNone,
+			"Read the docs and the FAQ.\n\n=> /a\n=> /b",
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := NewOptions(WithCitationStyle(testCase.style))
+		options.OmitLinkDisplay = true
+		if msg, err := wantString(input, testCase.output, *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestTableInListItem(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"<ul><li>Sizes<table><tr><td>S</td><td>M</td></tr></table></li><li>Colours</li></ul>",
+			"* Sizes\n\n```\n+---+---+\n| S | M |\n+---+---+\n```\n* Colours",
+		},
+		{
+			`<ul><li><table><tr><td>S</td><td><a href="/m">M</a></td></tr></table></li><li>Colours</li></ul>`,
+			"* \n\n```\n+---+-------+\n| S | M [1] |\n+---+-------+\n```\n\n=> /m [1] M\n\n* Colours",
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := NewOptions(WithPrettyTables(TableStyleASCII))
+		if msg, err := wantString(testCase.input, testCase.output, *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestNavFooterAppendix(t *testing.T) {
+	input := `<nav><ul><li><a href="/">Home</a></li><li><a href="/about">About</a></li></ul></nav>` +
+		`<p>Read <a href="/a">this</a> and <a href="/b">that</a>.</p><footer>© <a href="/me">Me</a> 2024</footer>`
+	output := "Read this [1] and that [2].\n\n=> /a [1] this\n=> /b [2] that\n\n" +
+		"## Navigation\n\n=> / Home\n=> /about About\n\n## Footer\n\n© Me [3] 2024\n\n=> /me [3] Me"
+
+	options := NewOptions()
+	options.NavFooterPlacement = NavFooterAppendix
+	if msg, err := wantString(input, output, *options); err != nil {
+		t.Error(err)
+	} else if len(msg) > 0 {
+		t.Log(msg)
+	}
+}
+
+func TestCompactPre(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			"Text<pre>code</pre>after",
+			"Text\n```\ncode\n```\nafter",
+		},
+		{
+			"<p>Para</p><pre class=\"language-go\">x := 1</pre><p>Next</p>",
+			"Para\n```go\nx := 1\n```\nNext",
+		},
+		{
+			"<blockquote>Quoted<pre>code</pre>text</blockquote>",
+			"> Quoted\n> ```\n> code\n> ```\n> text",
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := NewOptions()
+		options.CompactPre = true
+		if msg, err := wantString(testCase.input, testCase.output, *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestAttributeCharacterReferences(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			`See <a href="a.php?x=1&amp;y=2">this</a> page`,
+			"See this [1] page\n\n=> a.php?x=1&y=2 [1] this",
+		},
+		{
+			`See <a href="/search?q=&#x41;&#66;&amp;page=2">this</a> page`,
+			"See this [1] page\n\n=> /search?q=AB&page=2 [1] this",
+		},
+		{
+			//a named reference followed by = is not decoded in an attribute, as with a bare &
+			`See <a href="a.php?x=1&y=2&copy=3">this</a> page`,
+			"See this [1] page\n\n=> a.php?x=1&y=2&copy=3 [1] this",
+		},
+		{
+			`A <img src="chart.php?w=1&amp;h=2" alt="Sales &amp; costs"> chart`,
+			"A [‡ Sales & costs] [1] chart\n\n=> chart.php?w=1&h=2 [1] [‡ Sales & costs]",
+		},
+	}
+
+	for _, testCase := range testCases {
+		if msg, err := wantString(testCase.input, testCase.output, *NewOptions()); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
+func TestCompactLinkRuns(t *testing.T) {
+	testCases := []struct {
+		input  string
+		output string
+	}{
+		{
+			`<nav><a href="/">Home</a> | <a href="/blog">Blog</a> | <a href="/about">About</a> | ` +
+				`<a href="/contact">Contact</a> | <a href="/rss">RSS</a></nav><p>Body text</p>`,
+			"=> / Home\n=> /blog Blog\n=> /about About\n=> /contact Contact\n=> /rss RSS\n\nBody text",
+		},
+		{
+			`<p>Tags: <a href="/t/go">go</a>, <a href="/t/html">html</a>, <a href="/t/gemini">gemini</a>. ` +
+				`More on <a href="/more">this</a> later.</p>`,
+			"Tags:\n=> /t/go go\n=> /t/html html\n=> /t/gemini gemini\nMore on this [1] later.\n\n=> /more [1] this",
+		},
+		{
+			`<p>See <a href="/a">this</a>, <a href="/b">that</a> and <a href="/c">the other</a>.</p>`,
+			"See this [1], that [2] and the other [3].\n\n=> /a [1] this\n=> /b [2] that\n=> /c [3] the other",
+		},
+		{
+			`<p><a href="/a">a</a> | <a href="/b">b</a> | <a href="/c">c</a> | "quoted" (and bracketed) text</p>`,
+			"=> /a a\n=> /b b\n=> /c c\n\"quoted\" (and bracketed) text",
+		},
+	}
+
+	for _, testCase := range testCases {
+		options := NewOptions()
+		options.CompactLinkRuns = true
+		options.IncludeNav = true
+		if msg, err := wantString(testCase.input, testCase.output, *options); err != nil {
+			t.Error(err)
+		} else if len(msg) > 0 {
+			t.Log(msg)
+		}
+	}
+}
+
 type StringMatcher interface {
 	MatchString(string) bool
 	String() string